@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/srrathi/distributed-image-processor/database"
+)
+
+// Removes the store visits that a redelivered job message wrote a second time
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only report the duplicates, do not delete them")
+	flag.Parse()
+
+	db, err := database.NewStore()
+	if err != nil {
+		log.Fatal("Could not load database,", err)
+	}
+
+	report, err := db.RemoveDuplicateStoreVisits(*dryRun)
+	if err != nil {
+		log.Fatal("Error removing duplicate store visits:", err)
+	}
+
+	if *dryRun {
+		log.Printf("Found %d duplicate store visits: %v\n", len(report.Duplicates), report.Duplicates)
+		log.Printf("%d store visits would get their job id from their images\n", report.Backfilled)
+	} else {
+		log.Printf("Removed %d duplicate store visits: %v\n", len(report.Duplicates), report.Duplicates)
+		log.Printf("%d store visits got their job id from their images\n", report.Backfilled)
+	}
+	if report.UnknownJob > 0 {
+		log.Printf("%d store visits have no job id and no images, they were not checked\n", report.UnknownJob)
+	}
+}
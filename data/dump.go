@@ -5,13 +5,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/srrathi/distributed-image-processor/database"
 	"github.com/srrathi/distributed-image-processor/models"
 )
 
 func main() {
-	db, err := database.NewConnection()
+	db, err := database.NewStore()
 	if err != nil {
 		log.Fatal("Error opening CSV file:", err)
 	}
@@ -47,11 +49,20 @@ func main() {
 			StoreName: record[1],
 			StoreId:   record[2],
 		}
+		// Optional latitude and longitude columns locate the store
+		if len(record) >= 5 {
+			latitude, latErr := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
+			longitude, longErr := strconv.ParseFloat(strings.TrimSpace(record[4]), 64)
+			if latErr == nil && longErr == nil {
+				store.Latitude = &latitude
+				store.Longitude = &longitude
+			}
+		}
 		stores = append(stores, store)
 	}
 
 	// Insert data in bulk
-	if err := db.Create(&stores).Error; err != nil {
+	if err := db.CreateStores(&stores); err != nil {
 		log.Fatal("Error inserting records into the database:", err)
 	}
 
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Keys store visits can be aggregated by
+const (
+	GroupByStore = "store"
+	GroupByArea  = "area"
+)
+
+// Periods store visits can be aggregated over, weeks start on Monday and all periods are in UTC
+const (
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+)
+
+// VisitAggregate sums up the store visits of one store or area in one period
+// Period is the first day of the period as YYYY-MM-DD
+type VisitAggregate struct {
+	Key            string `gorm:"column:group_key"`
+	Period         string
+	Visits         int64
+	TotalPerimeter int64
+	AvgPerimeter   float64
+	MinPerimeter   int64
+	MaxPerimeter   int64
+	Images         int64
+}
+
+// AggregateStoreVisits groups the store visits matching the filter by store or area and period
+// and returns the aggregates ordered by key and period
+func AggregateStoreVisits(db *gorm.DB, filter StoreVisitsFilter, groupBy, interval string) ([]VisitAggregate, error) {
+	var key string
+	switch groupBy {
+	case GroupByStore:
+		key = "store_visits.store_id"
+	case GroupByArea:
+		key = "store_visits.store_area"
+	default:
+		return nil, fmt.Errorf("unknown group %q", groupBy)
+	}
+	period, err := periodExpression(db, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	// Images are counted per visit first, joining them directly would count a visit once per image
+	var aggregates []VisitAggregate
+	err = storeVisitsQuery(db, filter).
+		Select(fmt.Sprintf(`%s AS group_key, %s AS period,
+			COUNT(*) AS visits,
+			SUM(store_visits.perimeter) AS total_perimeter,
+			AVG(store_visits.perimeter) AS avg_perimeter,
+			MIN(store_visits.perimeter) AS min_perimeter,
+			MAX(store_visits.perimeter) AS max_perimeter,
+			COALESCE(SUM(visit_image_counts.images), 0) AS images`, key, period)).
+		Joins("LEFT JOIN (SELECT visit_id, COUNT(*) AS images FROM visit_images GROUP BY visit_id) visit_image_counts ON visit_image_counts.visit_id = store_visits.id").
+		Group(fmt.Sprintf("%s, %s", key, period)).
+		Order("group_key, period").
+		Scan(&aggregates).Error
+	if err != nil {
+		return nil, err
+	}
+	return aggregates, nil
+}
+
+// periodExpression returns the SQL that turns visit_time into the first day of its period
+func periodExpression(db *gorm.DB, interval string) (string, error) {
+	switch interval {
+	case IntervalDay, IntervalWeek, IntervalMonth:
+	default:
+		return "", fmt.Errorf("unknown interval %q", interval)
+	}
+
+	switch db.Dialector.Name() {
+	case DriverPostgres:
+		// date_trunc weeks start on Monday like ISO weeks
+		return fmt.Sprintf("to_char(date_trunc('%s', store_visits.visit_time AT TIME ZONE 'UTC'), 'YYYY-MM-DD')", interval), nil
+	case DriverSQLite:
+		switch interval {
+		case IntervalDay:
+			return "strftime('%Y-%m-%d', store_visits.visit_time)", nil
+		case IntervalWeek:
+			// %w is 0 for Sunday, the week starts on the Monday before
+			return "date(store_visits.visit_time, '-' || ((CAST(strftime('%w', store_visits.visit_time) AS INTEGER) + 6) % 7) || ' days')", nil
+		default:
+			return "strftime('%Y-%m-01', store_visits.visit_time)", nil
+		}
+	}
+	return "", fmt.Errorf("aggregation is not supported for database driver '%s'", db.Dialector.Name())
+}
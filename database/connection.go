@@ -1,57 +1,101 @@
 package database
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 
+	"github.com/glebarez/sqlite"
 	"github.com/joho/godotenv"
 	"github.com/srrathi/distributed-image-processor/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
 type Config struct {
+	Driver   string
 	Host     string
 	Port     string
 	Password string
 	User     string
 	DBName   string
 	SSLMode  string
+	// Path of the SQLite database file, ":memory:" keeps it in memory
+	Path string
 }
 
 func getDatabaseConfig() (*Config, error) {
+	// Without a .env file the configuration is taken from the environment only
 	err := godotenv.Load(".env")
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return nil, err
 	}
 
 	config := &Config{
+		Driver:   os.Getenv("DB_DRIVER"),
 		Host:     os.Getenv("DB_HOST"),
 		Port:     os.Getenv("DB_PORT"),
 		Password: os.Getenv("DB_PASSWORD"),
 		User:     os.Getenv("DB_USER"),
 		DBName:   os.Getenv("DB_DATABASE"),
 		SSLMode:  os.Getenv("DB_SSLMODE"),
+		Path:     os.Getenv("DB_PATH"),
+	}
+	if config.Driver == "" {
+		config.Driver = DriverPostgres
+	}
+	if config.Path == "" {
+		config.Path = "ip_jobs.db"
 	}
 	return config, nil
 }
 
+// NewConnection opens the database selected by DB_DRIVER, Postgres by default, and migrates it
 func NewConnection() (*gorm.DB, error) {
 	config, err := getDatabaseConfig()
 	if err != nil {
 		return nil, err
 	}
+	return OpenConnection(config)
+}
 
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode,
-	)
+// OpenConnection opens and migrates the database described by config
+func OpenConnection(config *Config) (*gorm.DB, error) {
+	var db *gorm.DB
+	var err error
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		return nil, err
+	switch config.Driver {
+	case DriverPostgres:
+		dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+			config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode,
+		)
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Connected to Postgres")
+	case DriverSQLite:
+		db, err = gorm.Open(sqlite.Open(config.Path), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		// SQLite allows a single writer, and every connection to :memory: would be a new database
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+		log.Println("Connected to SQLite")
+	default:
+		return nil, fmt.Errorf("unsupported database driver '%s'", config.Driver)
 	}
-	log.Println("Connected to Postgres")
 
 	err = MigrateDatabases(db)
 	if err != nil {
@@ -61,6 +105,15 @@ func NewConnection() (*gorm.DB, error) {
 	return db, nil
 }
 
+// NewStore opens the configured database and wraps it in a Store
+func NewStore() (Store, error) {
+	db, err := NewConnection()
+	if err != nil {
+		return nil, err
+	}
+	return NewGormStore(db), nil
+}
+
 func MigrateDatabases(db *gorm.DB) error {
 	err := db.AutoMigrate(&models.JobStatus{})
 	if err != nil {
@@ -68,22 +121,82 @@ func MigrateDatabases(db *gorm.DB) error {
 		return err
 	}
 
+	err = reserveJobIds(db)
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	err = db.AutoMigrate(&models.IdempotencyRecord{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	err = db.AutoMigrate(&models.JobPayload{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	err = db.AutoMigrate(&models.OutboxMessage{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
 	err = db.AutoMigrate(&models.JobErrors{})
 	if err != nil {
 		log.Fatal(err)
 		return err
 	}
 
+	err = db.AutoMigrate(&models.StoreResult{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
 	err = db.AutoMigrate(&models.StoreData{})
 	if err != nil {
 		log.Fatal(err)
 		return err
 	}
 
+	err = db.AutoMigrate(&models.StoreMasterVersion{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	err = migrateVisitTime(db)
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
 	err = db.AutoMigrate(&models.StoreVisits{})
 	if err != nil {
 		log.Fatal(err)
 		return err
 	}
+
+	err = db.AutoMigrate(&models.VisitImage{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	err = db.AutoMigrate(&models.ImageContent{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	err = db.AutoMigrate(&models.ImageSource{})
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
 	return nil
 }
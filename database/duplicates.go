@@ -0,0 +1,94 @@
+package database
+
+import (
+	"github.com/srrathi/distributed-image-processor/models"
+	"gorm.io/gorm"
+)
+
+// DuplicateVisitsReport is the outcome of RemoveDuplicateStoreVisits
+type DuplicateVisitsReport struct {
+	// Visits that repeat an older visit of the same job, store and visit time
+	Duplicates []uint
+	// Visits written before the job id was recorded whose job id was recovered from their images
+	Backfilled int
+	// Visits written before the job id was recorded whose job is unknown, they are left as they are
+	UnknownJob int
+}
+
+// visitGroupRow is a store visit together with the oldest visit of the same job, store and visit time
+type visitGroupRow struct {
+	Id          uint
+	KeepId      uint
+	JobId       *uint64
+	StoredJobId *uint64
+}
+
+// RemoveDuplicateStoreVisits deletes the store visits that were written more than once for the same
+// job, store and visit time, together with their images, and keeps the oldest visit
+// Visits written before the job id was recorded get it from their images first
+// With dryRun nothing is changed and only the report is returned
+func RemoveDuplicateStoreVisits(db *gorm.DB, dryRun bool) (*DuplicateVisitsReport, error) {
+	var rows []visitGroupRow
+	err := db.Raw(`
+		WITH keyed AS (
+			SELECT sv.id, sv.job_id AS stored_job_id, sv.store_id, sv.visit_time,
+				COALESCE(sv.job_id, (SELECT MIN(vi.job_id) FROM visit_images vi WHERE vi.visit_id = sv.id)) AS job_id
+			FROM store_visits sv
+		)
+		SELECT id, job_id, stored_job_id,
+			MIN(id) OVER (PARTITION BY job_id, store_id, visit_time) AS keep_id
+		FROM keyed
+		ORDER BY id`).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DuplicateVisitsReport{}
+	backfill := make(map[uint64][]uint)
+	for _, row := range rows {
+		switch {
+		case row.JobId == nil:
+			report.UnknownJob++
+		case row.Id != row.KeepId:
+			report.Duplicates = append(report.Duplicates, row.Id)
+		case row.StoredJobId == nil:
+			backfill[*row.JobId] = append(backfill[*row.JobId], row.Id)
+			report.Backfilled++
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Duplicates go first, the unique index would reject backfilling a visit that still has one
+		for start := 0; start < len(report.Duplicates); start += queryChunkSize {
+			end := min(start+queryChunkSize, len(report.Duplicates))
+			chunk := report.Duplicates[start:end]
+
+			err := tx.Where("visit_id IN ?", chunk).Delete(&models.VisitImage{}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Where("id IN ?", chunk).Delete(&models.StoreVisits{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for jobId, visitIds := range backfill {
+			for start := 0; start < len(visitIds); start += queryChunkSize {
+				end := min(start+queryChunkSize, len(visitIds))
+				err := tx.Model(&models.StoreVisits{}).Where("id IN ?", visitIds[start:end]).Update("job_id", jobId).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StoreVisitExport is a store visit with the name of its store from the store master and the
+// number of its images, StoreName is empty for stores missing from the store master
+type StoreVisitExport struct {
+	Id        uint
+	JobId     uint64
+	StoreId   string
+	StoreName string
+	StoreArea string
+	VisitTime time.Time
+	Perimeter uint
+	Images    int64
+}
+
+// StreamStoreVisits calls fn for every store visit matching the filter in the order of the page
+// Rows are read from a database cursor one at a time, so any number of visits can be exported
+// without holding them in memory, page.Limit is ignored and an error of fn stops the stream
+// visit is reused for every row, fn must copy what it keeps
+func StreamStoreVisits(db *gorm.DB, filter StoreVisitsFilter, page StoreVisitsPage, fn func(visit *StoreVisitExport) error) error {
+	query, err := sortedStoreVisitsQuery(db, filter, page)
+	if err != nil {
+		return err
+	}
+
+	// The store master is not unique on store_id, the oldest entry is used like GetStoreInfoFromStoreId does
+	rows, err := query.
+		Select(`store_visits.id, COALESCE(store_visits.job_id, 0), store_visits.store_id,
+			COALESCE(store_data.store_name, ''), store_visits.store_area, store_visits.visit_time,
+			store_visits.perimeter, COALESCE(visit_image_counts.images, 0)`).
+		Joins("LEFT JOIN (SELECT store_id, MIN(id) AS id FROM store_data GROUP BY store_id) first_store_data ON first_store_data.store_id = store_visits.store_id").
+		Joins("LEFT JOIN store_data ON store_data.id = first_store_data.id").
+		Joins("LEFT JOIN (SELECT visit_id, COUNT(*) AS images FROM visit_images GROUP BY visit_id) visit_image_counts ON visit_image_counts.visit_id = store_visits.id").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var visit StoreVisitExport
+	for rows.Next() {
+		err := rows.Scan(&visit.Id, &visit.JobId, &visit.StoreId, &visit.StoreName, &visit.StoreArea,
+			&visit.VisitTime, &visit.Perimeter, &visit.Images)
+		if err != nil {
+			return err
+		}
+		if err := fn(&visit); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
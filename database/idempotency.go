@@ -0,0 +1,52 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetIdempotencyRecord returns the response stored for the key, nil when the key is unknown or older than ttl
+func GetIdempotencyRecord(db *gorm.DB, key string, ttl time.Duration) (*models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := db.Model(&models.IdempotencyRecord{}).
+		Where("idempotency_key = ? AND created_at >= ?", key, time.Now().UTC().Add(-ttl)).
+		First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// ClaimIdempotencyKey stores the response of a new request under its key, records older than ttl are forgotten first
+// When the key is already taken it returns the existing record and false
+// It is meant to run in the transaction of the job, so a failed request never leaves its key behind
+func ClaimIdempotencyKey(db *gorm.DB, record *models.IdempotencyRecord, ttl time.Duration) (*models.IdempotencyRecord, bool, error) {
+	err := db.Where("created_at < ?", time.Now().UTC().Add(-ttl)).Delete(&models.IdempotencyRecord{}).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	record.CreatedAt = time.Now().UTC()
+	// The unique index on the key makes concurrent requests with the same key race for a single row,
+	// the loser waits for the transaction of the winner and reads its record
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return record, true, nil
+	}
+
+	var existing models.IdempotencyRecord
+	err = db.Model(&models.IdempotencyRecord{}).Where("idempotency_key = ?", record.IdempotencyKey).First(&existing).Error
+	if err != nil {
+		return nil, false, err
+	}
+	return &existing, false, nil
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+func TestClaimIdempotencyKeyIsRolledBackWithItsJob(t *testing.T) {
+	store := newTestStore(t)
+	failed := errors.New("job failed")
+	err := store.Transaction(func(tx Store) error {
+		_, claimed, err := tx.ClaimIdempotencyKey(&models.IdempotencyRecord{IdempotencyKey: "key", RequestHash: "a", JobId: 1}, time.Hour)
+		if err != nil || !claimed {
+			t.Fatalf("claim: %v %v", claimed, err)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("got %v, want the error of the job", err)
+	}
+	record, err := store.GetIdempotencyRecord("key", time.Hour)
+	if err != nil || record != nil {
+		t.Fatalf("got %+v, %v after a rollback, want no record", record, err)
+	}
+
+	// The key can be used again right away
+	if _, claimed, err := store.ClaimIdempotencyKey(&models.IdempotencyRecord{IdempotencyKey: "key", RequestHash: "a", JobId: 2}, time.Hour); err != nil || !claimed {
+		t.Fatalf("claim after rollback: %v %v", claimed, err)
+	}
+	existing, claimed, err := store.ClaimIdempotencyKey(&models.IdempotencyRecord{IdempotencyKey: "key", RequestHash: "b", JobId: 3}, time.Hour)
+	if err != nil || claimed || existing.JobId != 2 {
+		t.Fatalf("second claim got %+v, %v, %v, want the record of job 2", existing, claimed, err)
+	}
+}
+
+func TestGetIdempotencyRecordForgetsExpiredKeys(t *testing.T) {
+	store := newTestStore(t)
+	if _, _, err := store.ClaimIdempotencyKey(&models.IdempotencyRecord{IdempotencyKey: "key", JobId: 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.GetIdempotencyRecord("key", time.Hour); err != nil || record == nil || record.JobId != 1 {
+		t.Fatalf("got %+v, %v, want the record of job 1", record, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if record, err := store.GetIdempotencyRecord("key", 5*time.Millisecond); err != nil || record != nil {
+		t.Fatalf("got %+v, %v, want an expired key to be unknown", record, err)
+	}
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetImageSource returns the cached response for url, nil when the url was never fetched
+func GetImageSource(db *gorm.DB, url string) (*models.ImageSource, error) {
+	// Find instead of First, a miss is expected and not worth logging
+	var sources []models.ImageSource
+	err := db.Model(&models.ImageSource{}).Where("url = ?", url).Limit(1).Find(&sources).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	return &sources[0], nil
+}
+
+// GetImageContent returns the decoded image with the given hash, nil when it is not known
+func GetImageContent(db *gorm.DB, hash string) (*models.ImageContent, error) {
+	// Find instead of First, a miss is expected and not worth logging
+	var contents []models.ImageContent
+	err := db.Model(&models.ImageContent{}).Where("hash = ?", hash).Limit(1).Find(&contents).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) == 0 {
+		return nil, nil
+	}
+	return &contents[0], nil
+}
+
+// SaveImage stores the decoded image and points the url at it, replacing the previous response for the url
+func SaveImage(db *gorm.DB, source *models.ImageSource, content *models.ImageContent) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// The same bytes always decode the same, a known hash is only replaced when it is decoded again,
+		// which happens for images cached before their EXIF data was read
+		err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(content).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "url"}},
+			DoUpdates: clause.AssignmentColumns([]string{"content_hash", "e_tag", "last_modified", "checked_at"}),
+		}).Create(source).Error
+	})
+}
+
+// MarkImageSourceChecked records that the cached response for url is still valid
+func MarkImageSourceChecked(db *gorm.DB, url string, checkedAt time.Time) error {
+	return db.Model(&models.ImageSource{}).Where("url = ?", url).Update("checked_at", checkedAt).Error
+}
+
+// DeleteStaleImages removes the urls not checked since before, the least recently checked urls beyond
+// maxSources and the images no url points at anymore, maxSources 0 keeps any number of urls
+func DeleteStaleImages(db *gorm.DB, before time.Time, maxSources int) error {
+	err := db.Where("checked_at < ?", before).Delete(&models.ImageSource{}).Error
+	if err != nil {
+		return err
+	}
+	if maxSources > 0 {
+		newest := db.Model(&models.ImageSource{}).Select("id").Order("checked_at DESC, id DESC").Limit(maxSources)
+		err = db.Where("id NOT IN (?)", newest).Delete(&models.ImageSource{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Where("hash NOT IN (?)", db.Model(&models.ImageSource{}).Select("content_hash")).Delete(&models.ImageContent{}).Error
+}
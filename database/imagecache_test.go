@@ -0,0 +1,52 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+func TestDeleteStaleImagesKeepsTheNewestSources(t *testing.T) {
+	store := newTestStore(t)
+	now := time.Now().UTC()
+	// Four urls checked a minute apart, the last two show the same image
+	for i, hash := range []string{"a", "b", "c", "c"} {
+		source := models.ImageSource{Url: fmt.Sprintf("https://images.example/%d.jpg", i), ContentHash: hash, CheckedAt: now.Add(time.Duration(i-4) * time.Minute)}
+		if err := store.SaveImage(&source, &models.ImageContent{Hash: hash, Orientation: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first url is past the retention, the second is beyond the two newest
+	if err := store.DeleteStaleImages(now.Add(-210*time.Second), 2); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{false, false, true, true} {
+		source, err := store.GetImageSource(fmt.Sprintf("https://images.example/%d.jpg", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (source != nil) != want {
+			t.Errorf("url %d kept %v, want %v", i, source != nil, want)
+		}
+	}
+	for hash, want := range map[string]bool{"a": false, "b": false, "c": true} {
+		content, err := store.GetImageContent(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (content != nil) != want {
+			t.Errorf("image %s kept %v, want %v", hash, content != nil, want)
+		}
+	}
+
+	// 0 keeps any number of urls
+	if err := store.DeleteStaleImages(now.Add(-time.Hour), 0); err != nil {
+		t.Fatal(err)
+	}
+	if source, err := store.GetImageSource("https://images.example/2.jpg"); err != nil || source == nil {
+		t.Fatalf("got %+v, %v, want the url kept", source, err)
+	}
+}
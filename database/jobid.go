@@ -0,0 +1,49 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// Job ids used to be random 7 digit numbers, ids allocated by the database start above that range
+// so they can never collide with a job submitted before
+const minAllocatedJobId = 9999999
+
+// reserveJobIds moves the job id sequence past every id that is already in use and makes sure
+// job ids are unique even in job_statuses tables that were created without a primary key
+func reserveJobIds(db *gorm.DB) error {
+	switch db.Dialector.Name() {
+	case DriverPostgres:
+		err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_job_statuses_job_id ON job_statuses (job_id)").Error
+		if err != nil {
+			// Only happens when random ids already collided, those rows need to be cleaned up by hand
+			log.Println("Could not enforce unique job ids, duplicate job_id rows exist in job_statuses:", err)
+		}
+
+		var sequence string
+		err = db.Raw("SELECT pg_get_serial_sequence('job_statuses', 'job_id')").Scan(&sequence).Error
+		if err != nil {
+			return err
+		}
+		if sequence == "" {
+			return errors.New("job_statuses.job_id has no sequence")
+		}
+		// last_value covers ids handed out to transactions that are not committed yet, so the
+		// sequence never moves backwards
+		return db.Exec(fmt.Sprintf(
+			"SELECT setval('%s', GREATEST((SELECT COALESCE(MAX(job_id), 0) FROM job_statuses), ?, (SELECT last_value FROM %s)))",
+			sequence, sequence,
+		), minAllocatedJobId).Error
+	case DriverSQLite:
+		// AUTOINCREMENT continues from the larger of sqlite_sequence and the largest job_id
+		err := db.Exec("INSERT INTO sqlite_sequence (name, seq) SELECT 'job_statuses', ? WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'job_statuses')", minAllocatedJobId).Error
+		if err != nil {
+			return err
+		}
+		return db.Exec("UPDATE sqlite_sequence SET seq = ? WHERE name = 'job_statuses' AND seq < ?", minAllocatedJobId, minAllocatedJobId).Error
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+	"gorm.io/gorm"
+)
+
+func EnqueueOutboxMessage(db *gorm.DB, message *models.OutboxMessage) error {
+	return db.Model(&models.OutboxMessage{}).Create(message).Error
+}
+
+// GetPendingOutboxMessages returns the oldest messages that were not published yet
+func GetPendingOutboxMessages(db *gorm.DB, limit int) ([]models.OutboxMessage, error) {
+	var messages []models.OutboxMessage
+	result := db.Model(&models.OutboxMessage{}).Where("sent_at IS NULL").Order("id").Limit(limit).Find(&messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return messages, nil
+}
+
+func MarkOutboxMessageSent(db *gorm.DB, id uint) error {
+	return db.Model(&models.OutboxMessage{}).Where("id = ?", id).Update("sent_at", time.Now().UTC()).Error
+}
+
+// MarkOutboxMessageFailed records a failed publish attempt, the message stays pending
+func MarkOutboxMessageFailed(db *gorm.DB, id uint, publishErr string) error {
+	return db.Model(&models.OutboxMessage{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":   gorm.Expr("attempts + 1"),
+		"last_error": publishErr,
+	}).Error
+}
+
+// DeleteSentOutboxMessages removes messages published before the given time
+func DeleteSentOutboxMessages(db *gorm.DB, before time.Time) error {
+	return db.Where("sent_at < ?", before).Delete(&models.OutboxMessage{}).Error
+}
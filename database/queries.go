@@ -3,11 +3,16 @@ package database
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/srrathi/distributed-image-processor/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// Maximum number of values bound in a single IN query
+const queryChunkSize = 1000
+
 func UpdateJobStatusDatabase(db *gorm.DB, jobId uint64, jobStatus string) error {
 	// Create a new JobStatus instance with the target JobID and other data
 	newJobStatus := models.JobStatus{
@@ -24,6 +29,35 @@ func UpdateJobStatusDatabase(db *gorm.DB, jobId uint64, jobStatus string) error
 	return nil
 }
 
+func SaveJobPayload(db *gorm.DB, payload *models.JobPayload) error {
+	return db.Model(&models.JobPayload{}).Create(payload).Error
+}
+
+func GetJobPayload(db *gorm.DB, jobId uint64) (*models.JobPayload, error) {
+	var payload models.JobPayload
+	err := db.Model(&models.JobPayload{}).Where("job_id = ?", jobId).First(&payload).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+// CreateJob inserts a new job with the given status and returns the job id allocated by the database
+func CreateJob(db *gorm.DB, jobStatus string) (uint64, error) {
+	newJobStatus := models.JobStatus{
+		JobStatus: jobStatus,
+	}
+	result := db.Model(&models.JobStatus{}).Create(&newJobStatus)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return newJobStatus.JobId, nil
+}
+
 func GetStoreAreaFromStoreId(db *gorm.DB, storeId string) (string, error) {
 	var record models.StoreData
 	err := db.Model(&models.StoreData{}).Where("store_id = ?", storeId).First(&record).Error
@@ -52,13 +86,56 @@ func WriteErrorStoresData(db *gorm.DB, data *[]models.JobErrors) error {
 	return nil
 }
 
+// WriteStoresVisitsData upserts the visits on job, store and visit time, so writing the visits
+// of a job again updates them instead of adding new ones
+// The ids of the written or updated visits are set on data
 func WriteStoresVisitsData(db *gorm.DB, data *[]models.StoreVisits) error {
-	result := db.Model(&models.StoreVisits{}).Create(data)
+	// Visit times are written in UTC, so they compare in time order also where SQLite stores them as text
+	for i := range *data {
+		(*data)[i].VisitTime = (*data)[i].VisitTime.UTC()
+	}
+
+	// A single upsert can not touch the same row twice, visits repeated within the job are
+	// written once and share the id
+	type visitKey struct {
+		jobId     uint64
+		storeId   string
+		visitTime time.Time
+	}
+	positions := make(map[visitKey]int)
+	var visits []models.StoreVisits
+	for _, visit := range *data {
+		key := visitKey{visit.JobId, visit.StoreId, visit.VisitTime}
+		if _, ok := positions[key]; !ok {
+			positions[key] = len(visits)
+			visits = append(visits, visit)
+		}
+	}
+
+	result := db.Model(&models.StoreVisits{}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "job_id"}, {Name: "store_id"}, {Name: "visit_time"}},
+		DoUpdates: clause.AssignmentColumns([]string{"store_area", "perimeter"}),
+	}).Create(&visits)
 
 	if result.Error != nil {
 		log.Println("Error performing bulk write:", result.Error)
 		return result.Error
 	}
+
+	for i, visit := range *data {
+		(*data)[i].Id = visits[positions[visitKey{visit.JobId, visit.StoreId, visit.VisitTime}]].Id
+	}
+	return nil
+}
+
+// DeleteJobResults removes the store visits, images, errors and store results a job wrote,
+// a job that is processed again writes them anew
+func DeleteJobResults(db *gorm.DB, jobId uint64) error {
+	for _, model := range []interface{}{&models.VisitImage{}, &models.StoreVisits{}, &models.JobErrors{}, &models.StoreResult{}} {
+		if err := db.Where("job_id = ?", jobId).Delete(model).Error; err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -77,6 +154,7 @@ func GetJobStatusData(db *gorm.DB, jobId uint64) (*models.JobStatus, error) {
 	return &jobStatusData, nil
 }
 
+// GetJobErrors returns the errors recorded for the job, a job without errors gets an empty list
 func GetJobErrors(db *gorm.DB, jobId uint64) ([]models.JobErrors, error) {
 	var jobErrors []models.JobErrors
 	result := db.Model(&models.JobErrors{}).Find(&jobErrors, "job_id=?", jobId)
@@ -84,22 +162,102 @@ func GetJobErrors(db *gorm.DB, jobId uint64) ([]models.JobErrors, error) {
 	if result.Error != nil {
 		// Handle errors during the query
 		return nil, result.Error
-	} else if result.RowsAffected == 0 {
-		// Handle case where no errors were found for the given job ID
-		return nil, fmt.Errorf("no errors found for Job ID %d", jobId)
 	}
 	return jobErrors, nil
 }
 
-func GetStoreVisits(query *gorm.DB) ([]models.StoreVisits, error) {
+func WriteStoreResults(db *gorm.DB, data *[]models.StoreResult) error {
+	for i := range *data {
+		(*data)[i].VisitTime = (*data)[i].VisitTime.UTC()
+	}
+	result := db.Model(&models.StoreResult{}).Create(data)
+
+	if result.Error != nil {
+		log.Println("Error performing bulk write:", result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func GetStoreResults(db *gorm.DB, jobId uint64) ([]models.StoreResult, error) {
+	var storeResults []models.StoreResult
+	result := db.Model(&models.StoreResult{}).Order("visit_index").Find(&storeResults, "job_id = ?", jobId)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return storeResults, nil
+}
+
+// storeVisitsQuery selects the store visits matching the filter
+func storeVisitsQuery(db *gorm.DB, filter StoreVisitsFilter) *gorm.DB {
+	query := db.Model(&models.StoreVisits{})
+	if len(filter.StoreIds) > 0 {
+		query = query.Where("store_visits.store_id IN ?", filter.StoreIds)
+	}
+	if len(filter.Areas) > 0 {
+		query = query.Where("store_visits.store_area IN ?", filter.Areas)
+	}
+	// Visit times are written in UTC, SQLite compares them as text so the bounds have to be in UTC too
+	if filter.StartDate != nil {
+		query = query.Where("store_visits.visit_time >= ?", filter.StartDate.UTC())
+	}
+	if filter.EndDate != nil {
+		query = query.Where("store_visits.visit_time <= ?", filter.EndDate.UTC())
+	}
+	return query
+}
+
+// GetStoreVisits returns a page of the store visits matching the filter
+// Pages are read by keyset, so a page is as fast to read as the first one and visits written
+// in the meantime don't shift the following pages
+func GetStoreVisits(db *gorm.DB, filter StoreVisitsFilter, page StoreVisitsPage) ([]models.StoreVisits, error) {
+	query, err := sortedStoreVisitsQuery(db, filter, page)
+	if err != nil {
+		return nil, err
+	}
+
 	var storeVisits []models.StoreVisits
-	result := query.Find(&storeVisits)
+	result := query.Limit(page.Limit).Find(&storeVisits)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return storeVisits, nil
 }
 
+// sortedStoreVisitsQuery selects the store visits matching the filter that follow page.After
+// in the order of the page, page.Limit is left to the caller
+func sortedStoreVisitsQuery(db *gorm.DB, filter StoreVisitsFilter, page StoreVisitsPage) (*gorm.DB, error) {
+	var column string
+	switch page.Sort {
+	case SortVisitTime, SortPerimeter, SortStoreId:
+		column = "store_visits." + page.Sort
+	default:
+		return nil, fmt.Errorf("unknown sort column %q", page.Sort)
+	}
+	direction, compare := "ASC", ">"
+	if page.Descending {
+		direction, compare = "DESC", "<"
+	}
+
+	query := storeVisitsQuery(db, filter)
+	if page.After != nil {
+		var value interface{}
+		switch page.Sort {
+		case SortVisitTime:
+			value = page.After.VisitTime.UTC()
+		case SortPerimeter:
+			value = page.After.Perimeter
+		case SortStoreId:
+			value = page.After.StoreId
+		}
+		query = query.Where(
+			fmt.Sprintf("(%s %s ? OR (%s = ? AND store_visits.id %s ?))", column, compare, column, compare),
+			value, value, page.After.Id,
+		)
+	}
+	return query.Order(fmt.Sprintf("%s %s, store_visits.id %s", column, direction, direction)), nil
+}
+
 func GetStoreInfoFromStoreId(db *gorm.DB, storeId string) (*models.StoreData, error) {
 	var storeInfo models.StoreData
 	err := db.Model(&models.StoreData{}).Where("store_id = ?", storeId).First(&storeInfo).Error
@@ -113,3 +271,132 @@ func GetStoreInfoFromStoreId(db *gorm.DB, storeId string) (*models.StoreData, er
 
 	return &storeInfo, nil
 }
+
+// GetKnownStoreIds returns which of the store ids are in the store master
+func GetKnownStoreIds(db *gorm.DB, storeIds []string) (map[string]bool, error) {
+	unique := make(map[string]bool)
+	var ids []string
+	for _, storeId := range storeIds {
+		if !unique[storeId] {
+			unique[storeId] = true
+			ids = append(ids, storeId)
+		}
+	}
+
+	known := make(map[string]bool)
+	// Query in chunks to stay below the bind parameter limit of the database
+	for start := 0; start < len(ids); start += queryChunkSize {
+		end := min(start+queryChunkSize, len(ids))
+
+		var found []string
+		result := db.Model(&models.StoreData{}).Distinct().Where("store_id IN ?", ids[start:end]).Pluck("store_id", &found)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, storeId := range found {
+			known[storeId] = true
+		}
+	}
+	return known, nil
+}
+
+// GetStoresByIds returns the stores of the store master with the given ids, unknown ids are left out
+// A store id repeated in the store master is returned once with its oldest entry, like GetStoreInfoFromStoreId does
+func GetStoresByIds(db *gorm.DB, storeIds []string) ([]models.StoreData, error) {
+	var stores []models.StoreData
+	seen := make(map[string]bool)
+	// Query in chunks to stay below the bind parameter limit of the database
+	for start := 0; start < len(storeIds); start += queryChunkSize {
+		end := min(start+queryChunkSize, len(storeIds))
+
+		var chunk []models.StoreData
+		result := db.Model(&models.StoreData{}).Order("id").Find(&chunk, "store_id IN ?", storeIds[start:end])
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, store := range chunk {
+			if !seen[store.StoreId] {
+				seen[store.StoreId] = true
+				stores = append(stores, store)
+			}
+		}
+	}
+	return stores, nil
+}
+
+// GetAllStores returns the whole store master ordered by id
+func GetAllStores(db *gorm.DB) ([]models.StoreData, error) {
+	var stores []models.StoreData
+	result := db.Model(&models.StoreData{}).Order("id").Find(&stores)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return stores, nil
+}
+
+// CreateStores adds stores to the store master and increases its version in the same transaction
+func CreateStores(db *gorm.DB, stores *[]models.StoreData) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.StoreData{}).Create(stores)
+		if result.Error != nil {
+			log.Println("Error performing bulk write:", result.Error)
+			return result.Error
+		}
+		return bumpStoreMasterVersion(tx)
+	})
+}
+
+// GetStoreMasterVersion returns the version of the store master, 0 before it was first changed
+func GetStoreMasterVersion(db *gorm.DB) (uint64, error) {
+	var versions []models.StoreMasterVersion
+	result := db.Model(&models.StoreMasterVersion{}).Limit(1).Find(&versions)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[0].Version, nil
+}
+
+func bumpStoreMasterVersion(db *gorm.DB) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"version": gorm.Expr("store_master_versions.version + 1")}),
+	}).Create(&models.StoreMasterVersion{Id: 1, Version: 1}).Error
+}
+
+func WriteVisitImages(db *gorm.DB, data *[]models.VisitImage) error {
+	result := db.Model(&models.VisitImage{}).Create(data)
+
+	if result.Error != nil {
+		log.Println("Error performing bulk write:", result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func GetJobVisitImages(db *gorm.DB, jobId uint64) ([]models.VisitImage, error) {
+	var images []models.VisitImage
+	result := db.Model(&models.VisitImage{}).Order("id").Find(&images, "job_id = ?", jobId)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return images, nil
+}
+
+func GetVisitImages(db *gorm.DB, visitIds []uint) ([]models.VisitImage, error) {
+	var images []models.VisitImage
+	// Query in chunks to stay below the bind parameter limit of the database
+	for start := 0; start < len(visitIds); start += queryChunkSize {
+		end := min(start+queryChunkSize, len(visitIds))
+
+		var chunk []models.VisitImage
+		result := db.Model(&models.VisitImage{}).Order("id").Find(&chunk, "visit_id IN ?", visitIds[start:end])
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		images = append(images, chunk...)
+	}
+	return images, nil
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+// newTestStore opens an empty SQLite database with all tables
+func newTestStore(t testing.TB) *GormStore {
+	t.Helper()
+	db, err := OpenConnection(&Config{Driver: DriverSQLite, Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewGormStore(db)
+}
+
+func TestStoreVisitsQuery(t *testing.T) {
+	store := newTestStore(t)
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	visits := []models.StoreVisits{
+		{JobId: 1, StoreId: "S1", StoreArea: "A1", Perimeter: 10, VisitTime: day(1)},
+		{JobId: 1, StoreId: "S1", StoreArea: "A1", Perimeter: 20, VisitTime: day(5)},
+		{JobId: 1, StoreId: "S2", StoreArea: "A1", Perimeter: 30, VisitTime: day(3)},
+		{JobId: 1, StoreId: "S3", StoreArea: "A2", Perimeter: 40, VisitTime: day(7)},
+		{JobId: 1, StoreId: "S4", StoreArea: "A3", Perimeter: 50, VisitTime: day(9)},
+	}
+	if err := store.WriteStoresVisitsData(&visits); err != nil {
+		t.Fatal(err)
+	}
+	date := func(d int) *time.Time { t := day(d); return &t }
+
+	tests := []struct {
+		name   string
+		filter StoreVisitsFilter
+		want   []uint
+	}{
+		{"no filter", StoreVisitsFilter{}, []uint{10, 20, 30, 40, 50}},
+		{"one store", StoreVisitsFilter{StoreIds: []string{"S1"}}, []uint{10, 20}},
+		{"store list", StoreVisitsFilter{StoreIds: []string{"S1", "S3"}}, []uint{10, 20, 40}},
+		{"area list", StoreVisitsFilter{Areas: []string{"A2", "A3"}}, []uint{40, 50}},
+		{"unknown store", StoreVisitsFilter{StoreIds: []string{"S9"}}, nil},
+		{"store and area", StoreVisitsFilter{StoreIds: []string{"S1", "S3"}, Areas: []string{"A1"}}, []uint{10, 20}},
+		{"store and conflicting area", StoreVisitsFilter{StoreIds: []string{"S3"}, Areas: []string{"A1"}}, nil},
+		{"only startdate", StoreVisitsFilter{StartDate: date(5)}, []uint{20, 40, 50}},
+		{"only enddate", StoreVisitsFilter{EndDate: date(3)}, []uint{10, 30}},
+		{"dates are inclusive", StoreVisitsFilter{StartDate: date(3), EndDate: date(7)}, []uint{20, 30, 40}},
+		{"area and dates", StoreVisitsFilter{Areas: []string{"A1"}, StartDate: date(2), EndDate: date(6)}, []uint{20, 30}},
+		{"all fields", StoreVisitsFilter{StoreIds: []string{"S1", "S2"}, Areas: []string{"A1"}, StartDate: date(4), EndDate: date(9)}, []uint{20}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var found []models.StoreVisits
+			if err := storeVisitsQuery(store.db, test.filter).Order("perimeter").Find(&found).Error; err != nil {
+				t.Fatal(err)
+			}
+			var perimeters []uint
+			for _, visit := range found {
+				perimeters = append(perimeters, visit.Perimeter)
+			}
+			if len(perimeters) != len(test.want) {
+				t.Fatalf("got perimeters %v, want %v", perimeters, test.want)
+			}
+			for i := range perimeters {
+				if perimeters[i] != test.want[i] {
+					t.Fatalf("got perimeters %v, want %v", perimeters, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetStoreVisitsComparesTimesInUTC(t *testing.T) {
+	store := newTestStore(t)
+	india := time.FixedZone("IST", 5*3600+1800)
+	pacific := time.FixedZone("PST", -8*3600)
+	// Read as text in their own offsets the visits are in the opposite order
+	visits := []models.StoreVisits{
+		{JobId: 1, StoreId: "S1", StoreArea: "A1", Perimeter: 10, VisitTime: time.Date(2024, 1, 1, 1, 0, 0, 0, pacific)},
+		{JobId: 1, StoreId: "S1", StoreArea: "A1", Perimeter: 20, VisitTime: time.Date(2024, 1, 1, 10, 0, 0, 0, india)},
+	}
+	if err := store.WriteStoresVisitsData(&visits); err != nil {
+		t.Fatal(err)
+	}
+
+	page := StoreVisitsPage{Sort: SortVisitTime, Limit: 1}
+	first, err := store.GetStoreVisits(StoreVisitsFilter{}, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || first[0].Perimeter != 20 {
+		t.Fatalf("first page %+v, want the visit at 04:30 UTC", first)
+	}
+	// The cursor may carry the time in another offset
+	after := first[0]
+	after.VisitTime = after.VisitTime.In(pacific)
+	page.After = &after
+	second, err := store.GetStoreVisits(StoreVisitsFilter{}, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 || second[0].Perimeter != 10 {
+		t.Fatalf("second page %+v, want the visit at 09:00 UTC", second)
+	}
+
+	start := time.Date(2024, 1, 1, 11, 30, 0, 0, india)
+	found, err := store.GetStoreVisits(StoreVisitsFilter{StartDate: &start}, StoreVisitsPage{Sort: SortVisitTime, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Perimeter != 10 {
+		t.Fatalf("visits after 06:00 UTC %+v, want the visit at 09:00 UTC", found)
+	}
+}
+
+func TestGetJobErrorsOfJobWithoutErrors(t *testing.T) {
+	store := newTestStore(t)
+	jobErrors, err := store.GetJobErrors(1)
+	if err != nil {
+		t.Fatalf("got error %v, want an empty list", err)
+	}
+	if len(jobErrors) != 0 {
+		t.Fatalf("got %d errors, want none", len(jobErrors))
+	}
+}
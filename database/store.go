@@ -0,0 +1,252 @@
+package database
+
+import (
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+	"gorm.io/gorm"
+)
+
+// StoreVisitsFilter narrows the store visits returned by GetStoreVisits, all set fields have to match
+// and empty fields are ignored, a visit matches a list when it matches any of its values
+type StoreVisitsFilter struct {
+	StoreIds  []string
+	Areas     []string
+	StartDate *time.Time
+	EndDate   *time.Time
+}
+
+// Columns store visits can be sorted by, visits with the same value are sorted by id
+const (
+	SortVisitTime = "visit_time"
+	SortPerimeter = "perimeter"
+	SortStoreId   = "store_id"
+)
+
+// StoreVisitsPage selects up to Limit store visits in the order of Sort
+// After is the last visit of the previous page, only its id and sort column are used, nil for the first page
+type StoreVisitsPage struct {
+	Sort       string
+	Descending bool
+	Limit      int
+	After      *models.StoreVisits
+}
+
+// Store is the persistence used by the services for jobs, job errors, the store master and store visits
+type Store interface {
+	// Transaction runs fn with a Store whose writes are committed together, or not at all if fn fails
+	Transaction(fn func(tx Store) error) error
+
+	CreateJob(jobStatus string) (uint64, error)
+	UpdateJobStatus(jobId uint64, jobStatus string) error
+	GetJobStatusData(jobId uint64) (*models.JobStatus, error)
+
+	GetIdempotencyRecord(key string, ttl time.Duration) (*models.IdempotencyRecord, error)
+	ClaimIdempotencyKey(record *models.IdempotencyRecord, ttl time.Duration) (*models.IdempotencyRecord, bool, error)
+
+	SaveJobPayload(payload *models.JobPayload) error
+	GetJobPayload(jobId uint64) (*models.JobPayload, error)
+
+	EnqueueOutboxMessage(message *models.OutboxMessage) error
+	GetPendingOutboxMessages(limit int) ([]models.OutboxMessage, error)
+	MarkOutboxMessageSent(id uint) error
+	MarkOutboxMessageFailed(id uint, publishErr string) error
+	DeleteSentOutboxMessages(before time.Time) error
+
+	DeleteJobResults(jobId uint64) error
+	WriteErrorStoresData(data *[]models.JobErrors) error
+	GetJobErrors(jobId uint64) ([]models.JobErrors, error)
+
+	WriteStoreResults(data *[]models.StoreResult) error
+	GetStoreResults(jobId uint64) ([]models.StoreResult, error)
+
+	CreateStores(stores *[]models.StoreData) error
+	GetStoreAreaFromStoreId(storeId string) (string, error)
+	GetStoreInfoFromStoreId(storeId string) (*models.StoreData, error)
+	GetKnownStoreIds(storeIds []string) (map[string]bool, error)
+	GetStoresByIds(storeIds []string) ([]models.StoreData, error)
+	GetAllStores() ([]models.StoreData, error)
+	GetStoreMasterVersion() (uint64, error)
+
+	WriteStoresVisitsData(data *[]models.StoreVisits) error
+	GetStoreVisits(filter StoreVisitsFilter, page StoreVisitsPage) ([]models.StoreVisits, error)
+	StreamStoreVisits(filter StoreVisitsFilter, page StoreVisitsPage, fn func(visit *StoreVisitExport) error) error
+	AggregateStoreVisits(filter StoreVisitsFilter, groupBy, interval string) ([]VisitAggregate, error)
+	RemoveDuplicateStoreVisits(dryRun bool) (*DuplicateVisitsReport, error)
+
+	GetImageSource(url string) (*models.ImageSource, error)
+	GetImageContent(hash string) (*models.ImageContent, error)
+	SaveImage(source *models.ImageSource, content *models.ImageContent) error
+	MarkImageSourceChecked(url string, checkedAt time.Time) error
+	DeleteStaleImages(before time.Time, maxSources int) error
+
+	WriteVisitImages(data *[]models.VisitImage) error
+	GetJobVisitImages(jobId uint64) ([]models.VisitImage, error)
+	GetVisitImages(visitIds []uint) ([]models.VisitImage, error)
+}
+
+// GormStore implements Store on top of GORM, it is used for both Postgres and SQLite
+type GormStore struct {
+	db *gorm.DB
+}
+
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db: db}
+}
+
+func (s *GormStore) Transaction(fn func(tx Store) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return fn(NewGormStore(tx))
+	})
+}
+
+func (s *GormStore) CreateJob(jobStatus string) (uint64, error) {
+	return CreateJob(s.db, jobStatus)
+}
+
+func (s *GormStore) UpdateJobStatus(jobId uint64, jobStatus string) error {
+	return UpdateJobStatusDatabase(s.db, jobId, jobStatus)
+}
+
+func (s *GormStore) GetJobStatusData(jobId uint64) (*models.JobStatus, error) {
+	return GetJobStatusData(s.db, jobId)
+}
+
+func (s *GormStore) GetIdempotencyRecord(key string, ttl time.Duration) (*models.IdempotencyRecord, error) {
+	return GetIdempotencyRecord(s.db, key, ttl)
+}
+
+func (s *GormStore) ClaimIdempotencyKey(record *models.IdempotencyRecord, ttl time.Duration) (*models.IdempotencyRecord, bool, error) {
+	return ClaimIdempotencyKey(s.db, record, ttl)
+}
+
+func (s *GormStore) SaveJobPayload(payload *models.JobPayload) error {
+	return SaveJobPayload(s.db, payload)
+}
+
+func (s *GormStore) GetJobPayload(jobId uint64) (*models.JobPayload, error) {
+	return GetJobPayload(s.db, jobId)
+}
+
+func (s *GormStore) EnqueueOutboxMessage(message *models.OutboxMessage) error {
+	return EnqueueOutboxMessage(s.db, message)
+}
+
+func (s *GormStore) GetPendingOutboxMessages(limit int) ([]models.OutboxMessage, error) {
+	return GetPendingOutboxMessages(s.db, limit)
+}
+
+func (s *GormStore) MarkOutboxMessageSent(id uint) error {
+	return MarkOutboxMessageSent(s.db, id)
+}
+
+func (s *GormStore) MarkOutboxMessageFailed(id uint, publishErr string) error {
+	return MarkOutboxMessageFailed(s.db, id, publishErr)
+}
+
+func (s *GormStore) DeleteSentOutboxMessages(before time.Time) error {
+	return DeleteSentOutboxMessages(s.db, before)
+}
+
+func (s *GormStore) DeleteJobResults(jobId uint64) error {
+	return DeleteJobResults(s.db, jobId)
+}
+
+func (s *GormStore) WriteErrorStoresData(data *[]models.JobErrors) error {
+	return WriteErrorStoresData(s.db, data)
+}
+
+func (s *GormStore) GetJobErrors(jobId uint64) ([]models.JobErrors, error) {
+	return GetJobErrors(s.db, jobId)
+}
+
+func (s *GormStore) WriteStoreResults(data *[]models.StoreResult) error {
+	return WriteStoreResults(s.db, data)
+}
+
+func (s *GormStore) GetStoreResults(jobId uint64) ([]models.StoreResult, error) {
+	return GetStoreResults(s.db, jobId)
+}
+
+func (s *GormStore) CreateStores(stores *[]models.StoreData) error {
+	return CreateStores(s.db, stores)
+}
+
+func (s *GormStore) GetStoreAreaFromStoreId(storeId string) (string, error) {
+	return GetStoreAreaFromStoreId(s.db, storeId)
+}
+
+func (s *GormStore) GetStoreInfoFromStoreId(storeId string) (*models.StoreData, error) {
+	return GetStoreInfoFromStoreId(s.db, storeId)
+}
+
+func (s *GormStore) GetKnownStoreIds(storeIds []string) (map[string]bool, error) {
+	return GetKnownStoreIds(s.db, storeIds)
+}
+
+func (s *GormStore) GetStoresByIds(storeIds []string) ([]models.StoreData, error) {
+	return GetStoresByIds(s.db, storeIds)
+}
+
+func (s *GormStore) GetAllStores() ([]models.StoreData, error) {
+	return GetAllStores(s.db)
+}
+
+func (s *GormStore) GetStoreMasterVersion() (uint64, error) {
+	return GetStoreMasterVersion(s.db)
+}
+
+func (s *GormStore) WriteStoresVisitsData(data *[]models.StoreVisits) error {
+	return WriteStoresVisitsData(s.db, data)
+}
+
+func (s *GormStore) GetStoreVisits(filter StoreVisitsFilter, page StoreVisitsPage) ([]models.StoreVisits, error) {
+	return GetStoreVisits(s.db, filter, page)
+}
+
+func (s *GormStore) StreamStoreVisits(filter StoreVisitsFilter, page StoreVisitsPage, fn func(visit *StoreVisitExport) error) error {
+	return StreamStoreVisits(s.db, filter, page, fn)
+}
+
+func (s *GormStore) AggregateStoreVisits(filter StoreVisitsFilter, groupBy, interval string) ([]VisitAggregate, error) {
+	return AggregateStoreVisits(s.db, filter, groupBy, interval)
+}
+
+func (s *GormStore) RemoveDuplicateStoreVisits(dryRun bool) (*DuplicateVisitsReport, error) {
+	return RemoveDuplicateStoreVisits(s.db, dryRun)
+}
+
+func (s *GormStore) GetImageSource(url string) (*models.ImageSource, error) {
+	return GetImageSource(s.db, url)
+}
+
+func (s *GormStore) GetImageContent(hash string) (*models.ImageContent, error) {
+	return GetImageContent(s.db, hash)
+}
+
+func (s *GormStore) SaveImage(source *models.ImageSource, content *models.ImageContent) error {
+	return SaveImage(s.db, source, content)
+}
+
+func (s *GormStore) MarkImageSourceChecked(url string, checkedAt time.Time) error {
+	return MarkImageSourceChecked(s.db, url, checkedAt)
+}
+
+func (s *GormStore) DeleteStaleImages(before time.Time, maxSources int) error {
+	return DeleteStaleImages(s.db, before, maxSources)
+}
+
+func (s *GormStore) WriteVisitImages(data *[]models.VisitImage) error {
+	return WriteVisitImages(s.db, data)
+}
+
+func (s *GormStore) GetJobVisitImages(jobId uint64) ([]models.VisitImage, error) {
+	return GetJobVisitImages(s.db, jobId)
+}
+
+func (s *GormStore) GetVisitImages(visitIds []uint) ([]models.VisitImage, error) {
+	return GetVisitImages(s.db, visitIds)
+}
+
+// GormStore must satisfy the Store interface
+var _ Store = (*GormStore)(nil)
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+// storeMasterCache is a Store that answers store master lookups from memory
+// The whole store master is loaded on first use and loaded again once its version changed,
+// the version is read at most every checkEvery and right away after CreateStores through the cache
+// Changes made inside Transaction are seen with the next version check
+type storeMasterCache struct {
+	Store
+	checkEvery time.Duration
+
+	mu        sync.RWMutex
+	stores    map[string]models.StoreData
+	version   uint64
+	loaded    bool
+	checkedAt time.Time
+}
+
+// NewStoreMasterCache wraps store so store master lookups don't hit the database
+func NewStoreMasterCache(store Store, checkEvery time.Duration) Store {
+	return &storeMasterCache{Store: store, checkEvery: checkEvery}
+}
+
+// snapshot returns the cached store master by store id, loading it first if it is missing or outdated
+// The returned map is never changed, a reload replaces it
+func (c *storeMasterCache) snapshot() (map[string]models.StoreData, error) {
+	c.mu.RLock()
+	if c.loaded && time.Since(c.checkedAt) < c.checkEvery {
+		stores := c.stores
+		c.mu.RUnlock()
+		return stores, nil
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another lookup may have checked while this one waited for the lock
+	if c.loaded && time.Since(c.checkedAt) < c.checkEvery {
+		return c.stores, nil
+	}
+
+	// The version is read before the stores, so a change made while loading is loaded on the next check
+	version, err := c.Store.GetStoreMasterVersion()
+	if err != nil {
+		return nil, err
+	}
+	if !c.loaded || version != c.version {
+		all, err := c.Store.GetAllStores()
+		if err != nil {
+			return nil, err
+		}
+		// The oldest entry of a repeated store id wins, like in the database lookups
+		stores := make(map[string]models.StoreData, len(all))
+		for _, store := range all {
+			if _, ok := stores[store.StoreId]; !ok {
+				stores[store.StoreId] = store
+			}
+		}
+		c.stores = stores
+		c.version = version
+		c.loaded = true
+	}
+	c.checkedAt = time.Now()
+	return c.stores, nil
+}
+
+// invalidate makes the next lookup check the version of the store master
+func (c *storeMasterCache) invalidate() {
+	c.mu.Lock()
+	c.checkedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *storeMasterCache) CreateStores(stores *[]models.StoreData) error {
+	defer c.invalidate()
+	return c.Store.CreateStores(stores)
+}
+
+func (c *storeMasterCache) GetStoreAreaFromStoreId(storeId string) (string, error) {
+	stores, err := c.snapshot()
+	if err != nil {
+		return "", err
+	}
+	return stores[storeId].StoreArea, nil
+}
+
+func (c *storeMasterCache) GetStoreInfoFromStoreId(storeId string) (*models.StoreData, error) {
+	stores, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	store, ok := stores[storeId]
+	if !ok {
+		return nil, nil
+	}
+	return &store, nil
+}
+
+func (c *storeMasterCache) GetKnownStoreIds(storeIds []string) (map[string]bool, error) {
+	stores, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, storeId := range storeIds {
+		if _, ok := stores[storeId]; ok {
+			known[storeId] = true
+		}
+	}
+	return known, nil
+}
+
+func (c *storeMasterCache) GetStoresByIds(storeIds []string) ([]models.StoreData, error) {
+	stores, err := c.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	var found []models.StoreData
+	seen := make(map[string]bool)
+	for _, storeId := range storeIds {
+		if store, ok := stores[storeId]; ok && !seen[storeId] {
+			seen[storeId] = true
+			found = append(found, store)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+// benchmarkStoreIds seeds a store master of 5000 stores and returns the ids of a page of 100 visits
+func benchmarkStoreIds(b *testing.B, store Store) []string {
+	b.Helper()
+	stores := make([]models.StoreData, 5000)
+	for i := range stores {
+		stores[i] = models.StoreData{StoreId: fmt.Sprintf("S%05d", i), StoreArea: fmt.Sprintf("A%d", i%50), StoreName: "Store"}
+	}
+	if err := store.CreateStores(&stores); err != nil {
+		b.Fatal(err)
+	}
+	storeIds := make([]string, 100)
+	for i := range storeIds {
+		storeIds[i] = stores[i*37].StoreId
+	}
+	return storeIds
+}
+
+func BenchmarkStoresPerStore(b *testing.B) {
+	store := newTestStore(b)
+	storeIds := benchmarkStoreIds(b, store)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, storeId := range storeIds {
+			if _, err := store.GetStoreInfoFromStoreId(storeId); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStoresByIds(b *testing.B) {
+	store := newTestStore(b)
+	storeIds := benchmarkStoreIds(b, store)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetStoresByIds(storeIds); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStoresByIdsCached(b *testing.B) {
+	store := NewStoreMasterCache(newTestStore(b), time.Hour)
+	storeIds := benchmarkStoreIds(b, store)
+	// The store master is loaded once, every lookup after it is answered from memory
+	if _, err := store.GetStoresByIds(storeIds); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetStoresByIds(storeIds); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStoreMasterCache(t *testing.T) {
+	store := newTestStore(t)
+	cache := NewStoreMasterCache(store, time.Hour)
+	stores := []models.StoreData{{StoreId: "S1", StoreArea: "A1"}}
+	if err := cache.CreateStores(&stores); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := cache.GetStoresByIds([]string{"S1", "S2"}); err != nil || len(found) != 1 {
+		t.Fatalf("got %+v, %v, want S1", found, err)
+	}
+
+	// Written past the cache, seen only once the version is checked again
+	stores = []models.StoreData{{StoreId: "S2", StoreArea: "A2"}}
+	if err := store.CreateStores(&stores); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := cache.GetStoreInfoFromStoreId("S2"); err != nil || info != nil {
+		t.Fatalf("got %+v, %v before the version check, want nothing", info, err)
+	}
+	cache.(*storeMasterCache).invalidate()
+	if area, err := cache.GetStoreAreaFromStoreId("S2"); err != nil || area != "A2" {
+		t.Fatalf("got %q, %v after the version check, want A2", area, err)
+	}
+}
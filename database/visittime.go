@@ -0,0 +1,31 @@
+package database
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// migrateVisitTime turns store_visits.visit_time into a timestamptz, it used to be declared as a Postgres time
+// A timestamp column is converted in place and keeps the date of every visit, the times being UTC
+// A time column never stored the date, its visits can only keep their time of day and are put on 1970-01-01 UTC
+// SQLite only needs the declared type changed, AutoMigrate rebuilds the table for that
+func migrateVisitTime(db *gorm.DB) error {
+	if db.Dialector.Name() != DriverPostgres {
+		return nil
+	}
+
+	var dataType string
+	err := db.Raw("SELECT data_type FROM information_schema.columns WHERE table_schema = CURRENT_SCHEMA() AND table_name = 'store_visits' AND column_name = 'visit_time'").Scan(&dataType).Error
+	if err != nil {
+		return err
+	}
+	switch dataType {
+	case "timestamp without time zone":
+		return db.Exec("ALTER TABLE store_visits ALTER COLUMN visit_time TYPE timestamptz USING visit_time AT TIME ZONE 'UTC'").Error
+	case "time without time zone":
+		log.Println("store_visits.visit_time has no dates, existing visits are moved to 1970-01-01 UTC")
+		return db.Exec("ALTER TABLE store_visits ALTER COLUMN visit_time TYPE timestamptz USING (DATE '1970-01-01' + visit_time) AT TIME ZONE 'UTC'").Error
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker is the message bus the services publish jobs to and consume them from
+// RabbitClient talks to a RabbitMQ server, MemoryBroker keeps everything in process
+// Both deliver at least once, a consumed message stays unacknowledged until Ack or Nack
+type Broker interface {
+	// DeclareTopology declares the queues and bindings, they are kept across reconnects
+	DeclareTopology(topology Topology) error
+	// Publish sends a payload onto an exchange with a given routingkey and waits for the broker to accept it
+	// The empty exchange routes directly to the queue named by routingKey
+	Publish(ctx context.Context, exchange, routingKey string, options amqp.Publishing) error
+	// Consume returns the deliveries of a queue, every delivery must be acked or nacked
+	Consume(queue, consumer string) (<-chan amqp.Delivery, error)
+	// Ack acknowledges that a delivery was processed
+	Ack(msg amqp.Delivery) error
+	// Nack rejects a delivery, with requeue it is delivered again, otherwise it is dead-lettered or dropped
+	Nack(msg amqp.Delivery, requeue bool) error
+	// Cancel stops the deliveries of a consumer and closes its channel
+	Cancel(consumer string) error
+	// Close releases the broker, unacknowledged deliveries are delivered again to the next consumer
+	Close() error
+}
+
+// QueueSpec describes a queue to declare
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	// Extra queue arguments such as x-message-ttl or x-dead-letter-exchange
+	Args amqp.Table
+}
+
+// BindingSpec connects a queue to an exchange using the binding rule
+type BindingSpec struct {
+	Queue    string
+	Binding  string
+	Exchange string
+}
+
+// Topology is the set of queues and bindings a service relies on
+type Topology struct {
+	Queues   []QueueSpec
+	Bindings []BindingSpec
+}
@@ -0,0 +1,449 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrUnroutable is returned by MemoryBroker.Publish when no queue matches the routing key
+var ErrUnroutable = errors.New("message is unroutable")
+
+// memoryMessage is a message sitting in a memory queue
+type memoryMessage struct {
+	id          uint64
+	exchange    string
+	routingKey  string
+	redelivered bool
+	publishing  amqp.Publishing
+}
+
+// memoryQueue holds the pending messages of a queue and the consumers reading it
+type memoryQueue struct {
+	spec     QueueSpec
+	messages []memoryMessage
+}
+
+// memoryConsumer is a consumer registered through MemoryBroker.Consume
+type memoryConsumer struct {
+	tag       string
+	queue     string
+	out       chan amqp.Delivery
+	cancelled bool
+	done      chan struct{}
+}
+
+// unackedMessage is a message handed to a consumer and waiting for an ack or nack
+type unackedMessage struct {
+	queue   string
+	message memoryMessage
+}
+
+// MemoryBroker is an in-process Broker with the same at least once semantics as RabbitMQ
+// Exchanges are topic exchanges that exist implicitly, the empty exchange routes by queue name
+// Queues honour x-message-ttl, x-dead-letter-exchange and x-dead-letter-routing-key
+// Unacknowledged messages are put back at the head of their queue on Nack with requeue or when
+// the broker is closed, cancelling their consumer leaves them to be acked or nacked like RabbitMQ does
+type MemoryBroker struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	queues    map[string]*memoryQueue
+	bindings  []BindingSpec
+	consumers map[string]*memoryConsumer
+	unacked   map[uint64]unackedMessage
+
+	nextMessageId  uint64
+	nextDeliveryId uint64
+	closed         bool
+}
+
+// NewMemoryBroker returns an empty in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		queues:    make(map[string]*memoryQueue),
+		consumers: make(map[string]*memoryConsumer),
+		unacked:   make(map[uint64]unackedMessage),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// DeclareTopology declares the queues and bindings, declaring an existing queue or binding is a no-op
+func (b *MemoryBroker) DeclareTopology(topology Topology) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClientClosed
+	}
+	for _, q := range topology.Queues {
+		if _, ok := b.queues[q.Name]; !ok {
+			b.queues[q.Name] = &memoryQueue{spec: q}
+		}
+	}
+	for _, binding := range topology.Bindings {
+		if _, ok := b.queues[binding.Queue]; !ok {
+			return fmt.Errorf("no queue '%s' to bind", binding.Queue)
+		}
+		if !b.hasBinding(binding) {
+			b.bindings = append(b.bindings, binding)
+		}
+	}
+	return nil
+}
+
+// hasBinding must be called with b.mu held
+func (b *MemoryBroker) hasBinding(binding BindingSpec) bool {
+	for _, existing := range b.bindings {
+		if existing == binding {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish routes the message onto every matching queue
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, routingKey string, options amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClientClosed
+	}
+	b.nextMessageId++
+	return b.route(memoryMessage{
+		id:         b.nextMessageId,
+		exchange:   exchange,
+		routingKey: routingKey,
+		publishing: options,
+	})
+}
+
+// route enqueues the message once on every queue matching its exchange and routing key,
+// even when several bindings of a queue match
+// It must be called with b.mu held
+func (b *MemoryBroker) route(msg memoryMessage) error {
+	var targets []string
+	matched := make(map[string]bool)
+	if msg.exchange == "" {
+		if _, ok := b.queues[msg.routingKey]; ok {
+			targets = append(targets, msg.routingKey)
+		}
+	} else {
+		for _, binding := range b.bindings {
+			if binding.Exchange == msg.exchange && topicMatches(binding.Binding, msg.routingKey) && !matched[binding.Queue] {
+				matched[binding.Queue] = true
+				targets = append(targets, binding.Queue)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return ErrUnroutable
+	}
+
+	for _, queue := range targets {
+		b.enqueue(queue, msg, false)
+	}
+	return nil
+}
+
+// enqueue appends msg to the queue, or puts it back at the head when it is requeued
+// It must be called with b.mu held
+func (b *MemoryBroker) enqueue(queue string, msg memoryMessage, front bool) {
+	q := b.queues[queue]
+	if front {
+		q.messages = append([]memoryMessage{msg}, q.messages...)
+	} else {
+		q.messages = append(q.messages, msg)
+	}
+
+	if ttl, ok := tableInt(q.spec.Args, "x-message-ttl"); ok {
+		time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+			b.expire(queue, msg.id)
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// expire dead-letters the message if it is still waiting in the queue
+func (b *MemoryBroker) expire(queue string, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	q := b.queues[queue]
+	for i, msg := range q.messages {
+		if msg.id == id {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			b.deadLetter(q, msg)
+			return
+		}
+	}
+}
+
+// deadLetter re-routes a rejected or expired message to the queue's dead letter exchange
+// The message is dropped when the queue has no dead letter exchange
+// It must be called with b.mu held
+func (b *MemoryBroker) deadLetter(q *memoryQueue, msg memoryMessage) {
+	exchange, ok := q.spec.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	msg.exchange = exchange
+	if routingKey, ok := q.spec.Args["x-dead-letter-routing-key"].(string); ok {
+		msg.routingKey = routingKey
+	}
+	msg.redelivered = false
+	// Like RabbitMQ, a message that cannot be dead-lettered anywhere is dropped
+	_ = b.route(msg)
+}
+
+// Consume registers a consumer on the queue, messages are spread over the consumers of a queue
+func (b *MemoryBroker) Consume(queue, consumer string) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClientClosed
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return nil, fmt.Errorf("no queue '%s' to consume", queue)
+	}
+	if _, ok := b.consumers[consumer]; ok {
+		return nil, fmt.Errorf("consumer tag %s is already in use", consumer)
+	}
+
+	c := &memoryConsumer{
+		tag:   consumer,
+		queue: queue,
+		out:   make(chan amqp.Delivery),
+		done:  make(chan struct{}),
+	}
+	b.consumers[consumer] = c
+	go b.dispatch(c)
+	return c.out, nil
+}
+
+// dispatch hands the messages of the queue to the consumer one at a time
+func (b *MemoryBroker) dispatch(c *memoryConsumer) {
+	defer close(c.out)
+	for {
+		b.mu.Lock()
+		q := b.queues[c.queue]
+		for len(q.messages) == 0 && !c.cancelled {
+			b.cond.Wait()
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		b.nextDeliveryId++
+		tag := b.nextDeliveryId
+		b.unacked[tag] = unackedMessage{queue: c.queue, message: msg}
+		b.mu.Unlock()
+
+		delivery := amqp.Delivery{
+			Acknowledger:    memoryAcknowledger{b},
+			Headers:         msg.publishing.Headers,
+			ContentType:     msg.publishing.ContentType,
+			ContentEncoding: msg.publishing.ContentEncoding,
+			DeliveryMode:    msg.publishing.DeliveryMode,
+			Priority:        msg.publishing.Priority,
+			CorrelationId:   msg.publishing.CorrelationId,
+			ReplyTo:         msg.publishing.ReplyTo,
+			Expiration:      msg.publishing.Expiration,
+			MessageId:       msg.publishing.MessageId,
+			Timestamp:       msg.publishing.Timestamp,
+			Type:            msg.publishing.Type,
+			UserId:          msg.publishing.UserId,
+			AppId:           msg.publishing.AppId,
+			ConsumerTag:     c.tag,
+			DeliveryTag:     tag,
+			Redelivered:     msg.redelivered,
+			Exchange:        msg.exchange,
+			RoutingKey:      msg.routingKey,
+			Body:            msg.publishing.Body,
+		}
+
+		select {
+		case c.out <- delivery:
+		case <-c.done:
+			// Never reached the consumer, put it back for somebody else
+			memoryAcknowledger{b}.Nack(tag, false, true)
+			return
+		}
+	}
+}
+
+// Ack acknowledges a delivery received from Consume
+func (b *MemoryBroker) Ack(msg amqp.Delivery) error {
+	return msg.Ack(false)
+}
+
+// Nack negatively acknowledges a delivery received from Consume
+func (b *MemoryBroker) Nack(msg amqp.Delivery, requeue bool) error {
+	return msg.Nack(false, requeue)
+}
+
+// Cancel stops the deliveries of the consumer, its unacknowledged deliveries can still be acked
+func (b *MemoryBroker) Cancel(consumer string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.consumers[consumer]
+	if !ok {
+		return fmt.Errorf("no consumer registered with tag %s", consumer)
+	}
+	b.cancel(c)
+	return nil
+}
+
+// cancel must be called with b.mu held
+func (b *MemoryBroker) cancel(c *memoryConsumer) {
+	delete(b.consumers, c.tag)
+	c.cancelled = true
+	close(c.done)
+	b.cond.Broadcast()
+}
+
+// Close cancels every consumer and requeues all unacknowledged deliveries
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	for _, c := range b.consumers {
+		b.cancel(c)
+	}
+	b.requeueUnacked()
+	b.closed = true
+	return nil
+}
+
+// requeueUnacked puts every unacknowledged delivery back, like RabbitMQ does when a channel closes
+// It must be called with b.mu held
+func (b *MemoryBroker) requeueUnacked() {
+	for tag, u := range b.unacked {
+		u.message.redelivered = true
+		b.enqueue(u.queue, u.message, true)
+		delete(b.unacked, tag)
+	}
+}
+
+// QueueLength returns the number of messages waiting in a queue, unacknowledged deliveries excluded
+func (b *MemoryBroker) QueueLength(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0
+	}
+	return len(q.messages)
+}
+
+// memoryAcknowledger implements amqp.Acknowledger so deliveries can be acked with msg.Ack as well
+type memoryAcknowledger struct {
+	b *MemoryBroker
+}
+
+func (a memoryAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.b.settle(tag, multiple, func(unackedMessage) {})
+}
+
+func (a memoryAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.b.settle(tag, multiple, func(u unackedMessage) {
+		if requeue {
+			u.message.redelivered = true
+			a.b.enqueue(u.queue, u.message, true)
+			return
+		}
+		a.b.deadLetter(a.b.queues[u.queue], u.message)
+	})
+}
+
+func (a memoryAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// settle removes the delivery, and with multiple every earlier one, from the unacked set
+func (b *MemoryBroker) settle(tag uint64, multiple bool, fn func(unackedMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClientClosed
+	}
+	u, ok := b.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	if multiple {
+		for t, earlier := range b.unacked {
+			if t < tag {
+				delete(b.unacked, t)
+				fn(earlier)
+			}
+		}
+	}
+	delete(b.unacked, tag)
+	fn(u)
+	return nil
+}
+
+// topicMatches reports whether the routing key matches a topic binding,
+// * matches exactly one word and # matches zero or more words
+func topicMatches(binding, routingKey string) bool {
+	return matchWords(strings.Split(binding, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+}
+
+// tableInt reads an integer queue argument
+func tableInt(table amqp.Table, key string) (int64, bool) {
+	switch v := table[key].(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// MemoryBroker must satisfy the Broker interface
+var _ Broker = (*MemoryBroker)(nil)
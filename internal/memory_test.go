@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var testTopology = Topology{
+	Queues:   []QueueSpec{{Name: "jobs", Durable: true}},
+	Bindings: []BindingSpec{{Queue: "jobs", Binding: "jobs.create.*", Exchange: "events"}},
+}
+
+func newTestBroker(t *testing.T, topology Topology) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	if err := b.DeclareTopology(topology); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func publish(t *testing.T, b *MemoryBroker, exchange, routingKey, body string) {
+	t.Helper()
+	if err := b.Publish(context.Background(), exchange, routingKey, amqp.Publishing{Body: []byte(body)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery within a second")
+	}
+	return amqp.Delivery{}
+}
+
+func TestMemoryBrokerPublishConsumeAck(t *testing.T) {
+	b := newTestBroker(t, testTopology)
+	publish(t, b, "events", "jobs.create.ip", "job 1")
+
+	deliveries, err := b.Consume("jobs", "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, deliveries)
+	if string(d.Body) != "job 1" || d.RoutingKey != "jobs.create.ip" || d.Redelivered {
+		t.Fatalf("unexpected delivery %+v", d)
+	}
+	if err := b.Ack(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ack(d); err == nil {
+		t.Fatal("acking a delivery twice succeeded")
+	}
+
+	if err := b.Cancel("consumer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-deliveries; ok {
+		t.Fatal("deliveries still open after Cancel")
+	}
+	if n := b.QueueLength("jobs"); n != 0 {
+		t.Fatalf("queue length %d after ack, want 0", n)
+	}
+}
+
+func TestMemoryBrokerCancelKeepsUnackedDeliveries(t *testing.T) {
+	b := newTestBroker(t, testTopology)
+	publish(t, b, "events", "jobs.create.ip", "job 1")
+
+	deliveries, err := b.Consume("jobs", "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, deliveries)
+	if err := b.Cancel("consumer"); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.QueueLength("jobs"); n != 0 {
+		t.Fatalf("queue length %d after Cancel, want the delivery to stay unacked", n)
+	}
+
+	if err := b.Nack(d, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.QueueLength("jobs"); n != 1 {
+		t.Fatalf("queue length %d after Nack, want 1", n)
+	}
+}
+
+func TestMemoryBrokerUnroutable(t *testing.T) {
+	b := newTestBroker(t, testTopology)
+	err := b.Publish(context.Background(), "events", "jobs.delete.ip", amqp.Publishing{})
+	if err != ErrUnroutable {
+		t.Fatalf("got %v, want ErrUnroutable", err)
+	}
+}
+
+func TestMemoryBrokerNackRequeue(t *testing.T) {
+	b := newTestBroker(t, testTopology)
+	publish(t, b, "events", "jobs.create.ip", "job 1")
+	publish(t, b, "events", "jobs.create.ip", "job 2")
+
+	deliveries, err := b.Consume("jobs", "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := receive(t, deliveries)
+	if err := b.Nack(first, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dispatcher may already hold job 2, a requeued message goes back to the head of the queue
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		d := receive(t, deliveries)
+		bodies = append(bodies, string(d.Body))
+		if string(d.Body) == "job 1" && !d.Redelivered {
+			t.Fatal("requeued delivery is not marked redelivered")
+		}
+		b.Ack(d)
+	}
+	if !(bodies[0] == "job 1" || bodies[1] == "job 1") {
+		t.Fatalf("requeued message was not delivered again, got %v", bodies)
+	}
+}
+
+func TestMemoryBrokerNackDeadLetters(t *testing.T) {
+	b := newTestBroker(t, Topology{
+		Queues: []QueueSpec{
+			{Name: "jobs", Args: amqp.Table{"x-dead-letter-exchange": "dead"}},
+			{Name: "jobs.dlq"},
+		},
+		Bindings: []BindingSpec{
+			{Queue: "jobs", Binding: "jobs.#", Exchange: "events"},
+			{Queue: "jobs.dlq", Binding: "#", Exchange: "dead"},
+		},
+	})
+	publish(t, b, "events", "jobs.create.ip", "job 1")
+
+	deliveries, _ := b.Consume("jobs", "consumer")
+	if err := b.Nack(receive(t, deliveries), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.QueueLength("jobs.dlq"); n != 1 {
+		t.Fatalf("dead letter queue length %d, want 1", n)
+	}
+}
+
+func TestMemoryBrokerTTLDeadLetters(t *testing.T) {
+	b := newTestBroker(t, Topology{
+		Queues: []QueueSpec{
+			{Name: "jobs.retry", Args: amqp.Table{
+				"x-message-ttl":             int32(20),
+				"x-dead-letter-exchange":    "events",
+				"x-dead-letter-routing-key": "jobs.create.ip",
+			}},
+			{Name: "jobs"},
+		},
+		Bindings: []BindingSpec{{Queue: "jobs", Binding: "jobs.create.*", Exchange: "events"}},
+	})
+	publish(t, b, "", "jobs.retry", "job 1")
+	if n := b.QueueLength("jobs.retry"); n != 1 {
+		t.Fatalf("retry queue length %d, want 1", n)
+	}
+
+	deliveries, _ := b.Consume("jobs", "consumer")
+	d := receive(t, deliveries)
+	if string(d.Body) != "job 1" || d.Exchange != "events" || d.RoutingKey != "jobs.create.ip" {
+		t.Fatalf("unexpected dead-lettered delivery %+v", d)
+	}
+	if n := b.QueueLength("jobs.retry"); n != 0 {
+		t.Fatalf("retry queue length %d after the ttl, want 0", n)
+	}
+}
+
+func TestMemoryBrokerRepeatedDeclare(t *testing.T) {
+	b := newTestBroker(t, testTopology)
+	// Submit and consumer both declare the jobs topology on the same broker
+	if err := b.DeclareTopology(testTopology); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "events", "jobs.create.ip", "job 1")
+	if n := b.QueueLength("jobs"); n != 1 {
+		t.Fatalf("queue length %d after one publish, want 1", n)
+	}
+}
+
+func TestMemoryBrokerCloseRequeuesUnacked(t *testing.T) {
+	b := NewMemoryBroker()
+	b.DeclareTopology(testTopology)
+	publish(t, b, "events", "jobs.create.ip", "job 1")
+
+	deliveries, _ := b.Consume("jobs", "consumer")
+	receive(t, deliveries)
+	b.Close()
+
+	if n := b.QueueLength("jobs"); n != 1 {
+		t.Fatalf("queue length %d after close, want the unacked message back", n)
+	}
+}
@@ -2,73 +2,403 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	// Initial wait before trying to reconnect after the broker went away
+	reconnectMinDelay = 1 * time.Second
+	// Upper bound for the exponential reconnect backoff
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// ErrClientClosed is returned when the client was closed by the caller
+var ErrClientClosed = errors.New("rabbitmq client is closed")
+
+// ConnectionState describes the current state of the RabbitClient connection
+type ConnectionState int32
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// queueDeclaration remembers a declared queue so it can be re-declared after a reconnect
+type queueDeclaration struct {
+	name       string
+	durable    bool
+	autodelete bool
+	args       amqp.Table
+}
+
+// bindingDeclaration remembers a declared binding so it can be re-declared after a reconnect
+type bindingDeclaration struct {
+	name     string
+	binding  string
+	exchange string
+}
+
+// subscription is a consumer registered through Consume, it outlives the amqp channel
+// so deliveries keep flowing to the caller after a reconnect
+type subscription struct {
+	queue    string
+	consumer string
+	out      chan amqp.Delivery
+	// forwarders counts the goroutines piping deliveries into out, after a reconnect the forwarder
+	// of the old channel can still be blocked on out while the one of the new channel runs
+	forwarders int
+	// cancelled is set by Cancel, out is closed once no forwarder is left
+	cancelled bool
+}
+
 // RabbitClient is used to keep track of the RabbitMQ connection
+// It watches the connection and channel for closure and transparently reconnects,
+// re-declares the topology and re-establishes the consumers
 type RabbitClient struct {
+	// The url used to (re)dial the broker
+	url string
+
+	mu sync.Mutex
 	// The connection that is used
 	conn *amqp.Connection
 	// The channel that processes/sends Messages
 	ch *amqp.Channel
+	// ready is closed while the client is connected, and replaced while reconnecting
+	ready chan struct{}
+
+	queues        []queueDeclaration
+	bindings      []bindingDeclaration
+	subscriptions []*subscription
+
+	state ConnectionState
+	// done is closed when the client is closed by the caller
+	done      chan struct{}
+	closeOnce sync.Once
+	// forwarders tracks the goroutines that pipe amqp deliveries into subscriptions
+	forwarders sync.WaitGroup
 }
 
 // ConnectRabbitMQ will spawn a Connection
 func ConnectRabbitMQ(username, password, host, vhost string) (*amqp.Connection, error) {
 	// Setup the Connection to RabbitMQ host using AMQP
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s/%s", username, password, host, vhost))
+	conn, err := amqp.Dial(rabbitURL(username, password, host, vhost))
 	if err != nil {
 		return nil, err
 	}
 	return conn, nil
 }
 
+func rabbitURL(username, password, host, vhost string) string {
+	return fmt.Sprintf("amqp://%s:%s@%s/%s", username, password, host, vhost)
+}
+
 // NewRabbitMQClient will connect and return a Rabbitclient with an open connection
-// Accepts a amqp Connection to be reused, to avoid spawning one TCP connection per concurrent client
-func NewRabbitMQClient(conn *amqp.Connection) (RabbitClient, error) {
+// The client keeps the credentials so it can redial the broker when the connection drops
+func NewRabbitMQClient(username, password, host, vhost string) (*RabbitClient, error) {
+	rc := &RabbitClient{
+		url:   rabbitURL(username, password, host, vhost),
+		ready: make(chan struct{}),
+		state: StateConnecting,
+		done:  make(chan struct{}),
+	}
+
+	conn, ch, err := rc.dial()
+	if err != nil {
+		return nil, err
+	}
+	rc.conn = conn
+	rc.ch = ch
+	rc.setState(StateConnected)
+	close(rc.ready)
+
+	go rc.watch(conn, ch)
+	return rc, nil
+}
+
+// dial opens a new connection and a channel in confirm mode
+func (rc *RabbitClient) dial() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(rc.url)
+	if err != nil {
+		return nil, nil, err
+	}
 	// Unique, Conncurrent Server Channel to process/send messages
 	// A good rule of thumb is to always REUSE Conn across applications
 	// But spawn a new Channel per routine
 	ch, err := conn.Channel()
 	if err != nil {
-		return RabbitClient{}, err
+		conn.Close()
+		return nil, nil, err
 	}
 	// Puts the Channel in confirm mode, which will allow waiting for ACK or NACK from the receiver
 	if err := ch.Confirm(false); err != nil {
-		return RabbitClient{}, err
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, ch, nil
+}
+
+// watch blocks until the connection or the channel is closed and then reconnects
+func (rc *RabbitClient) watch(conn *amqp.Connection, ch *amqp.Channel) {
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-rc.done:
+			return
+		case err := <-connClosed:
+			log.Println("RabbitMQ connection closed:", err)
+		case err := <-chClosed:
+			log.Println("RabbitMQ channel closed:", err)
+		}
+
+		rc.mu.Lock()
+		if rc.State() == StateClosed {
+			rc.mu.Unlock()
+			return
+		}
+		rc.setState(StateReconnecting)
+		rc.ready = make(chan struct{})
+		rc.mu.Unlock()
+		// The connection may still be alive when only the channel was closed
+		conn.Close()
+
+		var ok bool
+		conn, ch, ok = rc.reconnect()
+		if !ok {
+			return
+		}
 	}
+}
+
+// reconnect redials with exponential backoff until it succeeds or the client is closed
+func (rc *RabbitClient) reconnect() (*amqp.Connection, *amqp.Channel, bool) {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-rc.done:
+			return nil, nil, false
+		case <-time.After(delay):
+		}
+
+		conn, ch, err := rc.dial()
+		if err == nil {
+			err = rc.restore(conn, ch)
+			if err == nil {
+				log.Printf("Reconnected to RabbitMQ after %d attempt(s)\n", attempt)
+				return conn, ch, true
+			}
+			conn.Close()
+		}
+		log.Printf("Reconnect attempt %d to RabbitMQ failed: %s\n", attempt, err)
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// restore re-declares the topology and consumers on a fresh channel and swaps it in
+func (rc *RabbitClient) restore(conn *amqp.Connection, ch *amqp.Channel) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.State() == StateClosed {
+		return ErrClientClosed
+	}
+
+	for _, q := range rc.queues {
+		if _, err := ch.QueueDeclare(q.name, q.durable, q.autodelete, false, false, q.args); err != nil {
+			return err
+		}
+	}
+	for _, b := range rc.bindings {
+		if err := ch.QueueBind(b.name, b.binding, b.exchange, false, nil); err != nil {
+			return err
+		}
+	}
+
+	deliveries := make([]<-chan amqp.Delivery, len(rc.subscriptions))
+	for i, sub := range rc.subscriptions {
+		d, err := ch.Consume(sub.queue, sub.consumer, false, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+		deliveries[i] = d
+	}
+	for i, sub := range rc.subscriptions {
+		rc.forward(sub, deliveries[i])
+	}
+
+	rc.conn = conn
+	rc.ch = ch
+	rc.setState(StateConnected)
+	close(rc.ready)
+	return nil
+}
+
+// forward pipes deliveries of one amqp consumer into the long lived subscription channel
+// It must be called with rc.mu held
+func (rc *RabbitClient) forward(sub *subscription, deliveries <-chan amqp.Delivery) {
+	rc.forwarders.Add(1)
+	sub.forwarders++
+	go func() {
+		defer rc.forwarders.Done()
+	loop:
+		for d := range deliveries {
+			select {
+			case sub.out <- d:
+			case <-rc.done:
+				break loop
+			}
+		}
 
-	return RabbitClient{
-		conn: conn,
-		ch:   ch,
-	}, nil
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		sub.forwarders--
+		if sub.cancelled && sub.forwarders == 0 {
+			close(sub.out)
+		}
+	}()
+}
+
+// channel returns the current channel, waiting for a reconnect to finish if needed
+func (rc *RabbitClient) channel(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		rc.mu.Lock()
+		state, ready, ch := rc.State(), rc.ready, rc.ch
+		rc.mu.Unlock()
+
+		if state == StateClosed {
+			return nil, ErrClientClosed
+		}
+		if state == StateConnected {
+			return ch, nil
+		}
+
+		select {
+		case <-ready:
+		case <-rc.done:
+			return nil, ErrClientClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (rc *RabbitClient) setState(state ConnectionState) {
+	atomic.StoreInt32((*int32)(&rc.state), int32(state))
+}
+
+// State returns the current connection state
+func (rc *RabbitClient) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32((*int32)(&rc.state)))
+}
+
+// IsConnected reports whether the client currently has an open connection and channel
+func (rc *RabbitClient) IsConnected() bool {
+	return rc.State() == StateConnected
 }
 
 // CreateQueue will create a new queue based on given cfgs
-func (rc RabbitClient) CreateQueue(queueName string, durable, autodelete bool) error {
-	_, err := rc.ch.QueueDeclare(queueName, durable, autodelete, false, false, nil)
-	return err
+// The queue is remembered and re-declared after a reconnect
+func (rc *RabbitClient) CreateQueue(queueName string, durable, autodelete bool) error {
+	return rc.CreateQueueWithArgs(queueName, durable, autodelete, nil)
 }
 
-// Close will close the channel
-func (rc RabbitClient) Close() error {
-	return rc.ch.Close()
+// CreateQueueWithArgs is CreateQueue with extra queue arguments such as x-message-ttl or x-dead-letter-exchange
+func (rc *RabbitClient) CreateQueueWithArgs(queueName string, durable, autodelete bool, args amqp.Table) error {
+	ch, err := rc.channel(context.Background())
+	if err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(queueName, durable, autodelete, false, false, args); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	rc.queues = append(rc.queues, queueDeclaration{name: queueName, durable: durable, autodelete: autodelete, args: args})
+	rc.mu.Unlock()
+	return nil
+}
+
+// Close will stop reconnecting and close the channel and the connection
+func (rc *RabbitClient) Close() error {
+	var err error
+	rc.closeOnce.Do(func() {
+		rc.mu.Lock()
+		rc.setState(StateClosed)
+		close(rc.done)
+		conn := rc.conn
+		subscriptions := rc.subscriptions
+		rc.mu.Unlock()
+
+		err = conn.Close()
+		if errors.Is(err, amqp.ErrClosed) {
+			err = nil
+		}
+
+		// Once every forwarder is gone nobody writes to the subscriptions anymore
+		rc.forwarders.Wait()
+		for _, sub := range subscriptions {
+			close(sub.out)
+		}
+	})
+	return err
 }
 
 // CreateBinding is used to connect a queue to an Exchange using the binding rule
-func (rc RabbitClient) CreateBinding(name, binding, exchange string) error {
+// The binding is remembered and re-declared after a reconnect
+func (rc *RabbitClient) CreateBinding(name, binding, exchange string) error {
+	ch, err := rc.channel(context.Background())
+	if err != nil {
+		return err
+	}
 	// leaving nowait false, having nowait set to false wctxill cause the channel to return an error and close if it cannot bind
 	// the final argument is the extra headers, but we wont be doing that now
-	return rc.ch.QueueBind(name, binding, exchange, false, nil)
+	if err := ch.QueueBind(name, binding, exchange, false, nil); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	rc.bindings = append(rc.bindings, bindingDeclaration{name: name, binding: binding, exchange: exchange})
+	rc.mu.Unlock()
+	return nil
 }
 
-// Send is used to publish a payload onto an exchange with a given routingkey
-func (rc RabbitClient) Send(ctx context.Context, exchange, routingKey string, options amqp.Publishing) error {
+// Publish is used to publish a payload onto an exchange with a given routingkey
+// While the client is reconnecting it waits for the connection until ctx is done
+func (rc *RabbitClient) Publish(ctx context.Context, exchange, routingKey string, options amqp.Publishing) error {
+	ch, err := rc.channel(ctx)
+	if err != nil {
+		return err
+	}
 	// PublishWithDeferredConfirmWithContext will wait for server to ACK the message
-	confirmation, err := rc.ch.PublishWithDeferredConfirmWithContext(ctx,
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx,
 		exchange,   // exchange
 		routingKey, // routing key
 		// Mandatory is used when we HAVE to have the message return an error, if there is no route or queue then
@@ -94,9 +424,97 @@ func (rc RabbitClient) Send(ctx context.Context, exchange, routingKey string, op
 // Consume is a wrapper around consume, it will return a Channel that can be used to digest messages
 // Queue is the name of the queue to Consume
 // Consumer is a unique identifier for the service instance that is consuming, can be used to cancel etc
-// autoAck is important to understand, if set to true, it will automatically Acknowledge that processing is done
-// This is good, but remember that if the Process fails before completion, then an ACK is already sent, making a message lost
-// if not handled properly
-func (rc RabbitClient) Consume(queue, consumer string, autoAck bool) (<-chan amqp.Delivery, error) {
-	return rc.ch.Consume(queue, consumer, autoAck, false, false, false, nil)
+// Messages are never auto acknowledged, if the Process fails before completion an ACK would already be sent,
+// making the message lost, so every delivery has to be acked or nacked
+// The returned channel survives reconnects and is only closed when the client is closed
+func (rc *RabbitClient) Consume(queue, consumer string) (<-chan amqp.Delivery, error) {
+	for {
+		ch, err := rc.channel(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		rc.mu.Lock()
+		// A reconnect swapped the channel in the meantime, register on the new one
+		if rc.ch != ch || rc.State() != StateConnected {
+			rc.mu.Unlock()
+			continue
+		}
+		deliveries, err := ch.Consume(queue, consumer, false, false, false, false, nil)
+		if err != nil {
+			rc.mu.Unlock()
+			return nil, err
+		}
+
+		sub := &subscription{
+			queue:    queue,
+			consumer: consumer,
+			out:      make(chan amqp.Delivery),
+		}
+		rc.subscriptions = append(rc.subscriptions, sub)
+		rc.forward(sub, deliveries)
+		rc.mu.Unlock()
+		return sub.out, nil
+	}
 }
+
+// Cancel stops the deliveries of the given consumer, the channel returned by Consume is
+// closed once the broker confirmed the cancel and the consumer is not restored on reconnect
+// Messages that were delivered but not acknowledged yet can still be acked or nacked
+func (rc *RabbitClient) Cancel(consumer string) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var remaining []*subscription
+	found := false
+	for _, sub := range rc.subscriptions {
+		if sub.consumer != consumer {
+			remaining = append(remaining, sub)
+			continue
+		}
+		found = true
+		sub.cancelled = true
+		if sub.forwarders == 0 {
+			// The amqp consumer is already gone with a closed channel
+			close(sub.out)
+		}
+	}
+	rc.subscriptions = remaining
+
+	if !found {
+		return fmt.Errorf("no consumer registered with tag %s", consumer)
+	}
+	if rc.State() != StateConnected {
+		return nil
+	}
+	return rc.ch.Cancel(consumer, false)
+}
+
+// DeclareTopology declares every queue and binding of the topology
+func (rc *RabbitClient) DeclareTopology(topology Topology) error {
+	for _, q := range topology.Queues {
+		if err := rc.CreateQueueWithArgs(q.Name, q.Durable, q.AutoDelete, q.Args); err != nil {
+			return err
+		}
+	}
+	for _, b := range topology.Bindings {
+		if err := rc.CreateBinding(b.Queue, b.Binding, b.Exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ack acknowledges a delivery received from Consume
+// Multiple means that we acknowledge a batch of messages, leave false for now
+func (rc *RabbitClient) Ack(msg amqp.Delivery) error {
+	return msg.Ack(false)
+}
+
+// Nack negatively acknowledges a delivery received from Consume
+func (rc *RabbitClient) Nack(msg amqp.Delivery, requeue bool) error {
+	return msg.Nack(false, requeue)
+}
+
+// RabbitClient must satisfy the Broker interface
+var _ Broker = (*RabbitClient)(nil)
@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+// VisitImage is the result of processing a single image of a store visit
+// VisitId is empty when the visit failed and no store visit was written
+// Width and Height are as the image is displayed, after its EXIF orientation is applied
+// StoreDistance is how far from the store, in meters, the image was taken when both locations are known
+type VisitImage struct {
+	Id               uint       `gorm:"primary key;autoIncrement" json:"id"`
+	VisitId          *uint      `gorm:"index" json:"visit_id"`
+	JobId            uint64     `gorm:"index" json:"job_id"`
+	StoreId          string     `json:"store_id"`
+	Url              string     `json:"url"`
+	Width            int        `json:"width"`
+	Height           int        `json:"height"`
+	Format           string     `json:"format"`
+	ByteSize         int64      `json:"byte_size"`
+	Perimeter        int        `json:"perimeter"`
+	Orientation      int        `json:"orientation"`
+	CapturedAt       *time.Time `json:"captured_at"`
+	CameraModel      string     `json:"camera_model"`
+	Latitude         *float64   `json:"latitude"`
+	Longitude        *float64   `json:"longitude"`
+	StoreDistance    *float64   `json:"store_distance"`
+	LocationMismatch bool       `json:"location_mismatch"`
+	ErrorCode        string     `json:"error_code,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// ImageContent is the decoded size and EXIF data of an image, keyed by the sha256 of its bytes
+// so the same image served from different URLs is stored once
+// Orientation is 1 for images without EXIF orientation and 0 for images cached before it was read
+type ImageContent struct {
+	Hash        string     `gorm:"primaryKey" json:"hash"`
+	Width       int        `json:"width"`
+	Height      int        `json:"height"`
+	Format      string     `json:"format"`
+	ByteSize    int64      `json:"byte_size"`
+	Orientation int        `json:"orientation"`
+	CapturedAt  *time.Time `json:"captured_at"`
+	CameraModel string     `json:"camera_model"`
+	Latitude    *float64   `json:"latitude"`
+	Longitude   *float64   `json:"longitude"`
+}
+
+// ImageSource is the last response for an image URL, ETag and LastModified are sent back
+// to revalidate it and CheckedAt is when the response was last fetched or revalidated
+type ImageSource struct {
+	Id           uint      `gorm:"primary key;autoIncrement" json:"id"`
+	Url          string    `gorm:"uniqueIndex" json:"url"`
+	ContentHash  string    `gorm:"index" json:"content_hash"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	CheckedAt    time.Time `gorm:"index" json:"checked_at"`
+}
@@ -1,17 +1,60 @@
 package models
 
+import "time"
+
+// JobStatus is the job record, JobId is allocated by the database when the job is created
 type JobStatus struct {
-	JobId     uint64 `gorm:"primary key;autoIncrement" json:"job_id"`
+	JobId     uint64 `gorm:"primaryKey;autoIncrement" json:"job_id"`
 	JobStatus string `json:"job_status" validate:"required"`
 }
 
+// JobErrors is a failure of a job, Code is one of the ERROR_ codes and Url is set when an image failed
 type JobErrors struct {
 	Id      uint   `gorm:"primary key;autoIncrement" json:"id"`
 	JobId   uint64 `json:"job_id" validate:"required"`
 	StoreId string `json:"store_id" validate:"required"`
+	Code    string `json:"code"`
+	Url     string `json:"url"`
 	Error   string `json:"error" validate:"required"`
 }
 
+// StoreResult is the outcome of a single store visit of a job
+// VisitIndex is the position of the visit in the submitted visits
+type StoreResult struct {
+	Id         uint      `gorm:"primary key;autoIncrement" json:"id"`
+	JobId      uint64    `gorm:"index" json:"job_id"`
+	VisitIndex int       `json:"visit_index"`
+	StoreId    string    `json:"store_id"`
+	VisitTime  time.Time `json:"visit_time"`
+	Status     string    `json:"status"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// JobPayload is the request a job was submitted with, kept for audit and retries
+// Visits holds the JSON encoded []StoreVisitData, ParentJobId is set for jobs retrying the failed visits of another job
+type JobPayload struct {
+	Id            uint      `gorm:"primary key;autoIncrement" json:"id"`
+	JobId         uint64    `gorm:"uniqueIndex" json:"job_id"`
+	ParentJobId   *uint64   `gorm:"index" json:"parent_job_id"`
+	Visits        string    `json:"visits"`
+	SubmittedAt   time.Time `json:"submitted_at"`
+	ClientId      string    `gorm:"index" json:"client_id"`
+	ClientAddress string    `json:"client_address"`
+	UserAgent     string    `json:"user_agent"`
+}
+
+// IdempotencyRecord remembers the response of a submission made with an Idempotency-Key
+// JobId is 0 while the first request with the key is still being processed
+type IdempotencyRecord struct {
+	Id             uint      `gorm:"primary key;autoIncrement" json:"id"`
+	IdempotencyKey string    `gorm:"uniqueIndex" json:"idempotency_key"`
+	RequestHash    string    `json:"request_hash"`
+	JobId          uint64    `json:"job_id"`
+	StatusCode     int       `json:"status_code"`
+	ResponseBody   string    `json:"response_body"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+}
+
 type JobData struct {
 	JobId     int             `json:"jobId" validate:"required"`
 	StoreJobs []StoreVisitData `json:"store_jobs" valiadte:"required"`
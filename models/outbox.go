@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// OutboxMessage is a message written in the same transaction as the job it belongs to
+// and published to RabbitMQ afterwards by the outbox relay, SentAt is set once published
+type OutboxMessage struct {
+	Id          uint       `gorm:"primary key;autoIncrement" json:"id"`
+	Exchange    string     `json:"exchange"`
+	RoutingKey  string     `json:"routing_key"`
+	ContentType string     `json:"content_type"`
+	Body        string     `json:"body"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SentAt      *time.Time `gorm:"index" json:"sent_at"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error"`
+}
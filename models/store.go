@@ -2,19 +2,33 @@ package models
 
 import "time"
 
+// StoreData is a store of the store master, Latitude and Longitude are optional
 type StoreData struct {
-	Id        uint   `gorm:"primary key;autoIncrement" json:"id"`
-	StoreId   string `json:"store_id" validate:"required"`
-	StoreArea string `json:"store_area" validate:"required"`
-	StoreName string `json:"store_name" validate:"required"`
+	Id        uint     `gorm:"primary key;autoIncrement" json:"id"`
+	StoreId   string   `gorm:"index" json:"store_id" validate:"required"`
+	StoreArea string   `json:"store_area" validate:"required"`
+	StoreName string   `json:"store_name" validate:"required"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
 }
 
+// StoreMasterVersion is increased with every change of the store master, so caches of the store
+// master in other processes notice the change, the table holds a single row
+type StoreMasterVersion struct {
+	Id      uint   `gorm:"primaryKey" json:"id"`
+	Version uint64 `json:"version"`
+}
+
+// StoreVisits is unique per job, store and visit time so a redelivered job does not write a visit twice
+// JobId is empty for visits written before it was recorded
+// StoreId, StoreArea and VisitTime are indexed for the filters and pages of the visits endpoint
 type StoreVisits struct {
 	Id        uint      `gorm:"primary key;autoIncrement" json:"id"`
-	StoreId   string    `json:"store_id" validate:"required"`
-	StoreArea string    `json:"store_area" validate:"required"`
+	JobId     uint64    `gorm:"uniqueIndex:idx_store_visits_job_store_time" json:"job_id"`
+	StoreId   string    `gorm:"uniqueIndex:idx_store_visits_job_store_time;index" json:"store_id" validate:"required"`
+	StoreArea string    `gorm:"index" json:"store_area" validate:"required"`
 	Perimeter uint      `json:"perimeter" validate:"required"`
-	VisitTime time.Time `gorm:"type:time" json:"visit_time" validate:"required"`
+	VisitTime time.Time `gorm:"uniqueIndex:idx_store_visits_job_store_time;index" json:"visit_time" validate:"required"`
 }
 
 type StoreVisitData struct {
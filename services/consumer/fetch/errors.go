@@ -0,0 +1,83 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+)
+
+// ErrorKind tells why a download failed
+type ErrorKind string
+
+const (
+	// The server did not answer or send the image within the timeout
+	ErrorTimeout ErrorKind = "timeout"
+	// The connection failed or broke off
+	ErrorNetwork ErrorKind = "network"
+	// The server answered with a status other than 2xx or 304
+	ErrorStatus ErrorKind = "status"
+	// The image is larger than the configured maximum
+	ErrorTooLarge ErrorKind = "too_large"
+	// The URL is malformed or not http or https, trying again can't help
+	ErrorInvalidURL ErrorKind = "invalid_url"
+)
+
+// Error is a failed download of URL, StatusCode is set for ErrorStatus
+type Error struct {
+	Kind       ErrorKind
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *Error) Error() string {
+	switch e.Kind {
+	case ErrorTimeout:
+		return fmt.Sprintf("fetching %s timed out: %s", e.URL, e.Err)
+	case ErrorStatus:
+		return fmt.Sprintf("fetching %s failed with HTTP %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	case ErrorTooLarge:
+		return fmt.Sprintf("image %s is too large: %s", e.URL, e.Err)
+	case ErrorInvalidURL:
+		return fmt.Sprintf("invalid image url %s: %s", e.URL, e.Err)
+	}
+	return fmt.Sprintf("fetching %s failed: %s", e.URL, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// temporary reports whether the download can succeed when tried again
+func (e *Error) temporary() bool {
+	switch e.Kind {
+	case ErrorTimeout, ErrorNetwork:
+		return true
+	case ErrorStatus:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// classify wraps an error of the http client or of reading a response body
+func classify(url string, err error) *Error {
+	var fetchErr *Error
+	if errors.As(err, &fetchErr) {
+		return fetchErr
+	}
+
+	// The url is part of the message already
+	var urlErr *neturl.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &Error{Kind: ErrorTimeout, URL: url, Err: err}
+	}
+	return &Error{Kind: ErrorNetwork, URL: url, Err: err}
+}
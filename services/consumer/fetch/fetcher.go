@@ -0,0 +1,237 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Config sets the limits of a Fetcher
+type Config struct {
+	// Downloads running at the same time across all jobs
+	MaxConcurrent int
+	// Downloads and connections to a single host
+	MaxPerHost int
+	// Time limit of connecting to the host
+	ConnectTimeout time.Duration
+	// Time limit of a download, including reading the body
+	Timeout time.Duration
+	// How long an unused keep-alive connection is kept open
+	IdleConnTimeout time.Duration
+	// Downloads tried per image, timeouts, network errors and 5xx responses are tried again
+	MaxAttempts int
+	// Base of the exponential backoff between attempts, the wait is a random duration up to the backoff
+	RetryDelay time.Duration
+	// Images larger than this are not downloaded
+	MaxBytes int64
+}
+
+// Fetcher downloads images for all jobs of the consumer through one http.Client, so the number
+// of downloads and open connections stays bounded no matter how many visits or jobs run
+// A download holds its slots until the response body is closed
+type Fetcher struct {
+	client      *http.Client
+	slots       chan struct{}
+	maxAttempts int
+	retryDelay  time.Duration
+	maxBytes    int64
+
+	perHost int
+	mu      sync.Mutex
+	hosts   map[string]chan struct{}
+}
+
+func NewFetcher(config Config) *Fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = config.MaxPerHost
+	transport.MaxIdleConnsPerHost = config.MaxPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.DialContext = (&net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = config.ConnectTimeout
+
+	return &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+		},
+		slots:       make(chan struct{}, config.MaxConcurrent),
+		maxAttempts: config.MaxAttempts,
+		retryDelay:  config.RetryDelay,
+		maxBytes:    config.MaxBytes,
+		perHost:     config.MaxPerHost,
+		hosts:       make(map[string]chan struct{}),
+	}
+}
+
+// Get downloads url with the given request headers and tries again on temporary failures
+// The response has status 2xx or 304 and its body fails once more than MaxBytes were read,
+// every error is an *Error
+func (f *Fetcher) Get(url string, header http.Header) (*http.Response, error) {
+	var lastErr *Error
+	for attempt := 1; attempt <= f.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(f.backoff(attempt - 1))
+		}
+
+		resp, err := f.get(url, header)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = classify(url, err)
+		if !lastErr.temporary() {
+			return nil, lastErr
+		}
+		log.Printf("Attempt %d of %d failed: %s\n", attempt, f.maxAttempts, lastErr)
+	}
+	return nil, lastErr
+}
+
+// get sends a single request for url and checks the response
+func (f *Fetcher) get(url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &Error{Kind: ErrorInvalidURL, URL: url, Err: err}
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, &Error{Kind: ErrorInvalidURL, URL: url, Err: fmt.Errorf("unsupported scheme %q", req.URL.Scheme)}
+	}
+	if req.URL.Host == "" {
+		return nil, &Error{Kind: ErrorInvalidURL, URL: url, Err: errors.New("missing host")}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := f.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusNotModified && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		resp.Body.Close()
+		return nil, &Error{Kind: ErrorStatus, URL: url, StatusCode: resp.StatusCode}
+	}
+	if f.maxBytes > 0 && resp.ContentLength > f.maxBytes {
+		resp.Body.Close()
+		return nil, &Error{Kind: ErrorTooLarge, URL: url, Err: fmt.Errorf("%d bytes, at most %d are allowed", resp.ContentLength, f.maxBytes)}
+	}
+
+	resp.Body = &limitedBody{ReadCloser: resp.Body, url: url, remaining: f.maxBytes, max: f.maxBytes}
+	return resp, nil
+}
+
+// backoff returns a random wait of up to RetryDelay doubled for every failed attempt
+func (f *Fetcher) backoff(failed int) time.Duration {
+	limit := f.retryDelay << (failed - 1)
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// Do sends req once a global and a per host slot are free, the caller has to close the response body
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	release, err := f.acquire(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// acquire waits for a global and a per host slot and returns the function that frees both
+func (f *Fetcher) acquire(ctx context.Context, host string) (func(), error) {
+	hostSlots := f.hostSlots(host)
+
+	// The host slot is taken first, so downloads queued for a busy host don't hold global slots
+	// that downloads from other hosts could use
+	select {
+	case hostSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case f.slots <- struct{}{}:
+	case <-ctx.Done():
+		<-hostSlots
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-hostSlots
+			<-f.slots
+		})
+	}, nil
+}
+
+// hostSlots returns the semaphore of host, hosts are kept for the lifetime of the fetcher
+func (f *Fetcher) hostSlots(host string) chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	slots, ok := f.hosts[host]
+	if !ok {
+		slots = make(chan struct{}, f.perHost)
+		f.hosts[host] = slots
+	}
+	return slots
+}
+
+// limitedBody fails once more than max bytes were read and classifies read errors
+type limitedBody struct {
+	io.ReadCloser
+	url       string
+	remaining int64
+	max       int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.max > 0 {
+		if b.remaining < 0 {
+			return 0, &Error{Kind: ErrorTooLarge, URL: b.url, Err: fmt.Errorf("more than %d bytes", b.max)}
+		}
+		// Read one byte past the limit to notice a body that is too large
+		if int64(len(p)) > b.remaining+1 {
+			p = p[:b.remaining+1]
+		}
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.max > 0 && b.remaining < 0 {
+		return n, &Error{Kind: ErrorTooLarge, URL: b.url, Err: fmt.Errorf("more than %d bytes", b.max)}
+	}
+	if err != nil && err != io.EOF {
+		return n, classify(b.url, err)
+	}
+	return n, err
+}
+
+// releasingBody frees the slots of a download when its body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,350 @@
+package fetch
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gauge tracks how many requests are answered at the same time
+type gauge struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (g *gauge) enter() {
+	g.mu.Lock()
+	g.current++
+	if g.current > g.max {
+		g.max = g.current
+	}
+	g.mu.Unlock()
+}
+
+func (g *gauge) leave() {
+	g.mu.Lock()
+	g.current--
+	g.mu.Unlock()
+}
+
+func (g *gauge) peak() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+// slowServer answers every request after a short wait and counts it on all gauges meanwhile
+func slowServer(t *testing.T, gauges ...*gauge) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, g := range gauges {
+			g.enter()
+		}
+		time.Sleep(20 * time.Millisecond)
+		for _, g := range gauges {
+			g.leave()
+		}
+		w.Write([]byte("image"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// download fetches url through f and reads and closes the body
+func download(f *Fetcher, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// downloadAll fetches every url at the same time
+func downloadAll(t *testing.T, f *Fetcher, urls []string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(urls))
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			errs <- download(f, url)
+		}(url)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFetcherPerHostLimit(t *testing.T) {
+	f := NewFetcher(Config{MaxConcurrent: 10, MaxPerHost: 2, Timeout: 5 * time.Second})
+	host := &gauge{}
+	server := slowServer(t, host)
+
+	urls := make([]string, 10)
+	for i := range urls {
+		urls[i] = server.URL + "/store.png"
+	}
+	downloadAll(t, f, urls)
+
+	if peak := host.peak(); peak != 2 {
+		t.Fatalf("%d downloads from one host at the same time, want 2", peak)
+	}
+}
+
+func TestFetcherGlobalLimitAcrossHosts(t *testing.T) {
+	f := NewFetcher(Config{MaxConcurrent: 3, MaxPerHost: 2, Timeout: 5 * time.Second})
+	total := &gauge{}
+	var urls []string
+	var hosts []*gauge
+	for i := 0; i < 4; i++ {
+		host := &gauge{}
+		hosts = append(hosts, host)
+		server := slowServer(t, host, total)
+		for j := 0; j < 4; j++ {
+			urls = append(urls, server.URL+"/store.png")
+		}
+	}
+	downloadAll(t, f, urls)
+
+	if peak := total.peak(); peak != 3 {
+		t.Fatalf("%d downloads at the same time, want 3", peak)
+	}
+	for i, host := range hosts {
+		if peak := host.peak(); peak > 2 {
+			t.Fatalf("%d downloads from host %d at the same time, want at most 2", peak, i)
+		}
+	}
+}
+
+func TestFetcherFreesSlotsOfFailedRequests(t *testing.T) {
+	f := NewFetcher(Config{MaxConcurrent: 1, MaxPerHost: 1, Timeout: 5 * time.Second})
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if err := download(f, closed.URL+"/store.png"); err == nil {
+		t.Fatal("download from a closed server succeeded")
+	}
+
+	// The only slot has to be free again for the next download
+	server := slowServer(t)
+	done := make(chan error, 1)
+	go func() { done <- download(f, server.URL+"/store.png") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the slot of the failed download was not freed")
+	}
+}
+
+// attemptServer answers with respond and counts the requests it got
+func attemptServer(t *testing.T, respond func(w http.ResponseWriter, req *http.Request, attempt int)) (*httptest.Server, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		attempts++
+		attempt := attempts
+		mu.Unlock()
+		respond(w, req, attempt)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts
+	}
+}
+
+func newTestFetcher() *Fetcher {
+	return NewFetcher(Config{
+		MaxConcurrent:  4,
+		MaxPerHost:     4,
+		ConnectTimeout: time.Second,
+		Timeout:        100 * time.Millisecond,
+		MaxAttempts:    3,
+		RetryDelay:     time.Millisecond,
+		MaxBytes:       1024,
+	})
+}
+
+func TestFetcherGet(t *testing.T) {
+	tests := []struct {
+		name       string
+		respond    func(w http.ResponseWriter, req *http.Request, attempt int)
+		attempts   int
+		kind       ErrorKind
+		statusCode int
+	}{
+		{
+			name:     "ok",
+			respond:  func(w http.ResponseWriter, req *http.Request, attempt int) { w.Write([]byte("image")) },
+			attempts: 1,
+		},
+		{
+			name: "5xx then ok",
+			respond: func(w http.ResponseWriter, req *http.Request, attempt int) {
+				if attempt == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte("image"))
+			},
+			attempts: 2,
+		},
+		{
+			name: "5xx is retried",
+			respond: func(w http.ResponseWriter, req *http.Request, attempt int) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			attempts:   3,
+			kind:       ErrorStatus,
+			statusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "4xx is not retried",
+			respond:    func(w http.ResponseWriter, req *http.Request, attempt int) { http.NotFound(w, req) },
+			attempts:   1,
+			kind:       ErrorStatus,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name: "network error is retried",
+			respond: func(w http.ResponseWriter, req *http.Request, attempt int) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			attempts: 3,
+			kind:     ErrorNetwork,
+		},
+		{
+			name: "timeout is retried",
+			respond: func(w http.ResponseWriter, req *http.Request, attempt int) {
+				select {
+				case <-req.Context().Done():
+				case <-time.After(time.Second):
+				}
+			},
+			attempts: 3,
+			kind:     ErrorTimeout,
+		},
+		{
+			name: "Content-Length above MaxBytes",
+			respond: func(w http.ResponseWriter, req *http.Request, attempt int) {
+				w.Header().Set("Content-Length", "2048")
+				w.Write(make([]byte, 2048))
+			},
+			attempts: 1,
+			kind:     ErrorTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, attempts := attemptServer(t, test.respond)
+			resp, err := newTestFetcher().Get(server.URL+"/store.png", nil)
+			if n := attempts(); n != test.attempts {
+				t.Fatalf("%d attempts, want %d", n, test.attempts)
+			}
+			if test.kind == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				return
+			}
+			var fetchErr *Error
+			if !errors.As(err, &fetchErr) {
+				t.Fatalf("got %v, want a fetch error", err)
+			}
+			if fetchErr.Kind != test.kind || fetchErr.StatusCode != test.statusCode {
+				t.Fatalf("got %s %d, want %s %d", fetchErr.Kind, fetchErr.StatusCode, test.kind, test.statusCode)
+			}
+		})
+	}
+}
+
+func TestFetcherStreamedBodyAboveMaxBytes(t *testing.T) {
+	server, attempts := attemptServer(t, func(w http.ResponseWriter, req *http.Request, attempt int) {
+		// Flushed in parts, so the response has no Content-Length
+		for i := 0; i < 4; i++ {
+			w.Write(make([]byte, 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	resp, err := newTestFetcher().Get(server.URL+"/store.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	var fetchErr *Error
+	if !errors.As(err, &fetchErr) || fetchErr.Kind != ErrorTooLarge {
+		t.Fatalf("got %v, want a too large error", err)
+	}
+	if n := attempts(); n != 1 {
+		t.Fatalf("%d attempts, want 1", n)
+	}
+}
+
+func TestFetcherBackoffIsRandom(t *testing.T) {
+	f := &Fetcher{retryDelay: 100 * time.Millisecond}
+	for failed := 1; failed <= 3; failed++ {
+		limit := f.retryDelay << (failed - 1)
+		waits := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			wait := f.backoff(failed)
+			if wait < 0 || wait >= limit {
+				t.Fatalf("backoff %s after %d failures, want below %s", wait, failed, limit)
+			}
+			waits[wait] = true
+		}
+		if len(waits) < 2 {
+			t.Fatalf("backoff after %d failures is always %v", failed, waits)
+		}
+	}
+	if wait := (&Fetcher{}).backoff(1); wait != 0 {
+		t.Fatalf("backoff %s without a retry delay, want 0", wait)
+	}
+}
+
+func TestInvalidURLIsNotRetried(t *testing.T) {
+	f := NewFetcher(Config{
+		MaxConcurrent:  1,
+		MaxPerHost:     1,
+		ConnectTimeout: time.Second,
+		Timeout:        time.Second,
+		MaxAttempts:    3,
+		RetryDelay:     time.Hour,
+	})
+	for _, url := range []string{"ftp://images.example.com/store.png", "http://%zz/store.png", "http:///store.png", "store.png"} {
+		_, err := f.Get(url, nil)
+		var fetchErr *Error
+		if !errors.As(err, &fetchErr) || fetchErr.Kind != ErrorInvalidURL {
+			t.Errorf("%s: got %v, want an invalid url error", url, err)
+			continue
+		}
+		if fetchErr.temporary() {
+			t.Errorf("%s: invalid url error is temporary", url)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package imagecache
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+// How often entries older than the retention period are removed
+const cleanupInterval = time.Hour
+
+// Entry is a cached image url together with its decoded image
+type Entry struct {
+	Source  models.ImageSource
+	Content models.ImageContent
+}
+
+// Cache remembers the decoded size of fetched images in the database
+// Errors of the cache are logged and treated as a miss, they never fail a job
+type Cache struct {
+	store      database.Store
+	freshFor   time.Duration
+	retention  time.Duration
+	maxEntries int
+}
+
+// New returns a cache that uses an entry without asking the server for freshFor after it was
+// fetched or revalidated, and forgets entries that were not revalidated for retention
+// Beyond maxEntries urls the least recently revalidated are forgotten too, 0 keeps any number
+func New(store database.Store, freshFor, retention time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		store:      store,
+		freshFor:   freshFor,
+		retention:  retention,
+		maxEntries: maxEntries,
+	}
+}
+
+// Lookup returns the cached entry of url, nil if there is none
+// fresh reports whether the entry can be used as it is, otherwise it has to be revalidated
+func (c *Cache) Lookup(url string) (entry *Entry, fresh bool) {
+	source, err := c.store.GetImageSource(url)
+	if err != nil {
+		log.Println("Error reading image cache:", err)
+		return nil, false
+	}
+	if source == nil {
+		return nil, false
+	}
+
+	content, err := c.store.GetImageContent(source.ContentHash)
+	if err != nil {
+		log.Println("Error reading image cache:", err)
+		return nil, false
+	}
+	// Images cached before the EXIF data was read are fetched again
+	if content == nil || content.Orientation == 0 {
+		return nil, false
+	}
+
+	entry = &Entry{Source: *source, Content: *content}
+	return entry, time.Since(source.CheckedAt) < c.freshFor
+}
+
+// LookupContent returns the decoded image with the given sha256 hash, nil if there is none
+// The same bytes always decode the same, so an image fetched from another url doesn't need to be decoded again
+func (c *Cache) LookupContent(hash string) *models.ImageContent {
+	content, err := c.store.GetImageContent(hash)
+	if err != nil {
+		log.Println("Error reading image cache:", err)
+		return nil
+	}
+	// Images cached before the EXIF data was read are decoded again
+	if content == nil || content.Orientation == 0 {
+		return nil
+	}
+	return content
+}
+
+// Revalidated records that the server confirmed the cached entry of url is unchanged
+func (c *Cache) Revalidated(url string) {
+	err := c.store.MarkImageSourceChecked(url, time.Now().UTC())
+	if err != nil {
+		log.Println("Error updating image cache:", err)
+	}
+}
+
+// Save caches the decoded image fetched from url, etag and lastModified are the validators of the response
+func (c *Cache) Save(url, etag, lastModified string, content models.ImageContent) {
+	source := models.ImageSource{
+		Url:          url,
+		ContentHash:  content.Hash,
+		ETag:         etag,
+		LastModified: lastModified,
+		CheckedAt:    time.Now().UTC(),
+	}
+	err := c.store.SaveImage(&source, &content)
+	if err != nil {
+		log.Println("Error writing image cache:", err)
+	}
+}
+
+// Run removes entries that were not revalidated for the retention period or are beyond maxEntries until ctx is cancelled
+func (c *Cache) Run(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		err := c.store.DeleteStaleImages(time.Now().UTC().Add(-c.retention), c.maxEntries)
+		if err != nil {
+			log.Println("Error cleaning up image cache:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
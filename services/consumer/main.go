@@ -4,11 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/internal"
 	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/services/consumer/fetch"
+	"github.com/srrathi/distributed-image-processor/services/consumer/imagecache"
 	"github.com/srrathi/distributed-image-processor/services/consumer/processing"
+	"github.com/srrathi/distributed-image-processor/services/consumer/retry"
 	"github.com/srrathi/distributed-image-processor/utils"
 	"golang.org/x/sync/errgroup"
 )
@@ -19,57 +28,107 @@ func main() {
 		panic(err)
 	}
 
-	messageBus, err := mqClient.Consume(utils.RBTMQ_QUEUE_NAME, utils.RBTMQ_CONSUMER, false)
+	// To connect to database
+	store, err := database.NewStore()
 	if err != nil {
 		panic(err)
 	}
+	store = database.NewStoreMasterCache(store, utils.GetDurationEnv("STORE_CACHE_CHECK_INTERVAL", utils.STORE_CACHE_CHECK_INTERVAL))
 
-	// To connect to database
-	db, err := database.NewConnection()
+	// ctx is cancelled on CTRL+C or SIGTERM, from then on no new job is started
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Sizes of images fetched before, shared by all jobs
+	cache := imagecache.New(
+		store,
+		utils.GetDurationEnv("IMAGE_CACHE_FRESH_FOR", utils.IMAGE_CACHE_FRESH_FOR),
+		utils.GetDurationEnv("IMAGE_CACHE_RETENTION", utils.IMAGE_CACHE_RETENTION),
+		utils.GetIntEnv("IMAGE_CACHE_MAX_ENTRIES", utils.IMAGE_CACHE_MAX_ENTRIES),
+	)
+	go cache.Run(ctx)
+
+	// Image downloads of all jobs share one client and its limits
+	fetcher := fetch.NewFetcher(fetch.Config{
+		MaxConcurrent:   utils.GetIntEnv("IMAGE_FETCH_CONCURRENCY", utils.IMAGE_FETCH_CONCURRENCY),
+		MaxPerHost:      utils.GetIntEnv("IMAGE_FETCH_PER_HOST", utils.IMAGE_FETCH_PER_HOST),
+		ConnectTimeout:  utils.GetDurationEnv("IMAGE_FETCH_CONNECT_TIMEOUT", utils.IMAGE_FETCH_CONNECT_TIMEOUT),
+		Timeout:         utils.GetDurationEnv("IMAGE_FETCH_TIMEOUT", utils.IMAGE_FETCH_TIMEOUT),
+		IdleConnTimeout: utils.GetDurationEnv("IMAGE_FETCH_IDLE_TIMEOUT", utils.IMAGE_FETCH_IDLE_TIMEOUT),
+		MaxAttempts:     utils.GetIntEnv("IMAGE_FETCH_MAX_ATTEMPTS", utils.IMAGE_FETCH_MAX_ATTEMPTS),
+		RetryDelay:      utils.GetDurationEnv("IMAGE_FETCH_RETRY_DELAY", utils.IMAGE_FETCH_RETRY_DELAY),
+		MaxBytes:        int64(utils.GetIntEnv("IMAGE_FETCH_MAX_BYTES", utils.IMAGE_FETCH_MAX_BYTES)),
+	})
+
+	processor := processing.NewProcessor(store, cache, fetcher, utils.GetListEnv("IMAGE_ALLOWED_FORMATS", utils.IMAGE_ALLOWED_FORMATS), float64(utils.GetIntEnv("IMAGE_MAX_STORE_DISTANCE", utils.IMAGE_MAX_STORE_DISTANCE)))
+
+	err = run(ctx, mqClient, store, processor, utils.GetDurationEnv("CONSUMER_SHUTDOWN_TIMEOUT", utils.CONSUMER_SHUTDOWN_TIMEOUT))
 	if err != nil {
 		panic(err)
 	}
 
-	// blocking is used to block forever
-	var blocking chan struct{}
+	err = mqClient.Close()
+	if err != nil {
+		log.Println("Error closing RabbitMQ client:", err)
+	}
+}
+
+// run consumes job messages from the broker until ctx is cancelled, then it waits up to
+// shutdownTimeout for the running jobs and requeues the ones that did not finish
+func run(ctx context.Context, broker internal.Broker, store database.Store, processor *processing.Processor, shutdownTimeout time.Duration) error {
+	// Declare the queues and bindings through the broker so they are restored after a broker restart
+	err := broker.DeclareTopology(utils.JobsTopology())
+	if err != nil {
+		return err
+	}
+	err = broker.DeclareTopology(retry.Topology())
+	if err != nil {
+		return err
+	}
+
+	// messageBus keeps delivering after the client reconnects to RabbitMQ
+	messageBus, err := broker.Consume(utils.RBTMQ_QUEUE_NAME, utils.RBTMQ_CONSUMER)
+	if err != nil {
+		return err
+	}
 
-	// Set a timeout for 15 secs
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
+	// Messages currently being processed, nacked with requeue if they don't finish in time
+	inflight := newInflightMessages()
 
 	// Create an Errgroup to manage concurrecy
-	g, _ := errgroup.WithContext(ctx)
+	g := new(errgroup.Group)
 	// Set amount of concurrent tasks
 	g.SetLimit(utils.RBTMQ_CONCURRENT_TASK_LIMIT)
+	consuming := make(chan struct{})
 	go func() {
+		defer close(consuming)
 		for message := range messageBus {
 			// Spawn a worker
 			msg := message
 			g.Go(func() error {
-				// Unmarshal the JSON data into the struct
-				var jobData models.JobData
-				err := json.Unmarshal(msg.Body, &jobData)
-				if err != nil {
-					log.Println("Error:", err)
-					return err
+				// Shutdown started while this message was waiting for a free worker
+				if ctx.Err() != nil {
+					requeue(broker, msg)
+					return nil
 				}
 
-				// Update job status to running
-				err = database.UpdateJobStatusDatabase(db, uint64(jobData.JobId), utils.JOB_RUNNING)
-				if err != nil {
-					log.Println("Error:", err)
-					return err
+				inflight.add(msg)
+				jobId, err := processMessage(store, processor, msg)
+				if !inflight.remove(msg) {
+					// Shutdown deadline passed and the message was already requeued
+					return nil
 				}
-				// Process images
-				err = processing.ProcessStoreVisits(jobData, db)
 				if err != nil {
 					log.Println("Error:", err)
-					return err
+					// Hand the message over to the retry queues or the dead letter queue
+					if err := retry.Reschedule(broker, store, msg, jobId, err); err != nil {
+						log.Println("Error rescheduling message, requeueing it:", err)
+						requeue(broker, msg)
+						return err
+					}
 				}
 
-				// Multiple means that we acknowledge a batch of messages, leave false for now
-				if err := msg.Ack(false); err != nil {
+				if err := broker.Ack(msg); err != nil {
 					log.Printf("Acknowledged message failed: Retry ? Handle manually %s\n", msg.MessageId)
 					return err
 				}
@@ -81,7 +140,99 @@ func main() {
 	}()
 
 	log.Println("Consuming, to close the program press CTRL+C")
-	// This will block forever
-	<-blocking
+	<-ctx.Done()
+
+	log.Printf("Shutting down, waiting up to %s for running jobs\n", shutdownTimeout)
+
+	// Stop the deliveries, messageBus is closed once the broker confirmed the cancel
+	err = broker.Cancel(utils.RBTMQ_CONSUMER)
+	if err != nil {
+		log.Println("Error cancelling consumer:", err)
+	}
 
+	drained := make(chan struct{})
+	go func() {
+		<-consuming
+		g.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Println("All running jobs finished")
+	case <-time.After(shutdownTimeout):
+		for _, msg := range inflight.drain() {
+			log.Println("Job did not finish in time, requeueing message:", msg.MessageId)
+			requeue(broker, msg)
+		}
+	}
+	return nil
+}
+
+// requeue nacks the message so the broker delivers it again
+func requeue(broker internal.Broker, msg amqp.Delivery) {
+	if err := broker.Nack(msg, true); err != nil {
+		log.Printf("Negative acknowledge failed: Retry ? Handle manually %s\n", msg.MessageId)
+	}
+}
+
+// inflightMessages tracks the deliveries that are being processed
+// Whoever removes a delivery first owns its ack or nack
+type inflightMessages struct {
+	mu       sync.Mutex
+	messages map[uint64]amqp.Delivery
+}
+
+func newInflightMessages() *inflightMessages {
+	return &inflightMessages{messages: make(map[uint64]amqp.Delivery)}
+}
+
+func (m *inflightMessages) add(msg amqp.Delivery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[msg.DeliveryTag] = msg
+}
+
+// remove reports false if the message was already taken by drain
+func (m *inflightMessages) remove(msg amqp.Delivery) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.messages[msg.DeliveryTag]
+	delete(m.messages, msg.DeliveryTag)
+	return ok
+}
+
+// drain takes all messages that are still being processed
+func (m *inflightMessages) drain() []amqp.Delivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var messages []amqp.Delivery
+	for tag, msg := range m.messages {
+		messages = append(messages, msg)
+		delete(m.messages, tag)
+	}
+	return messages
+}
+
+// processMessage runs a single job message, the returned job id is 0 when the message could not be decoded
+func processMessage(store database.Store, processor *processing.Processor, msg amqp.Delivery) (uint64, error) {
+	// Unmarshal the JSON data into the struct
+	var jobData models.JobData
+	err := json.Unmarshal(msg.Body, &jobData)
+	if err != nil {
+		return 0, err
+	}
+	jobId := uint64(jobData.JobId)
+
+	// Update job status to running
+	err = store.UpdateJobStatus(jobId, utils.JOB_RUNNING)
+	if err != nil {
+		return jobId, err
+	}
+	// Process images
+	err = processor.ProcessStoreVisits(jobData)
+	if err != nil {
+		return jobId, err
+	}
+	return jobId, nil
 }
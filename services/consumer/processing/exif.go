@@ -0,0 +1,79 @@
+package processing
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Bytes from the start of a JPEG to read its EXIF data from, the EXIF segment of a JPEG is at
+// most 64KB and comes before the image data, a TIFF is read as a whole
+const exifHeadSize = 128 << 10
+
+// imageMetadata is what the EXIF data of an image tells about it
+type imageMetadata struct {
+	orientation int
+	capturedAt  *time.Time
+	cameraModel string
+	latitude    *float64
+	longitude   *float64
+}
+
+// readExif reads the EXIF data from the first bytes of a JPEG or the whole of a TIFF image
+// Images without EXIF data get orientation 1, the image is displayed as stored
+func readExif(format string, head []byte) imageMetadata {
+	metadata := imageMetadata{orientation: 1}
+	if format != "jpeg" && format != "tiff" {
+		return metadata
+	}
+
+	// Broken or missing tags are skipped, the image itself was decoded fine
+	x, err := exif.Decode(bytes.NewReader(head))
+	if x == nil || (err != nil && exif.IsCriticalError(err)) {
+		return metadata
+	}
+
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if orientation, err := tag.Int(0); err == nil && orientation >= 1 && orientation <= 8 {
+			metadata.orientation = orientation
+		}
+	}
+	if capturedAt, err := x.DateTime(); err == nil {
+		capturedAt = capturedAt.UTC()
+		metadata.capturedAt = &capturedAt
+	}
+	if tag, err := x.Get(exif.Model); err == nil {
+		if model, err := tag.StringVal(); err == nil {
+			metadata.cameraModel = strings.TrimSpace(strings.TrimRight(model, "\x00"))
+		}
+	}
+	if latitude, longitude, err := x.LatLong(); err == nil && !math.IsNaN(latitude) && !math.IsNaN(longitude) {
+		metadata.latitude = &latitude
+		metadata.longitude = &longitude
+	}
+	return metadata
+}
+
+// orientedSize returns the size of the image as it is displayed
+// Orientations 5 to 8 are rotated by 90 degrees, so width and height swap
+func orientedSize(width, height, orientation int) (int, int) {
+	if orientation >= 5 && orientation <= 8 {
+		return height, width
+	}
+	return width, height
+}
+
+// distanceMeters returns the great circle distance between two coordinates in degrees
+func distanceMeters(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	const earthRadius = 6371000
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	deltaLatitude := toRadians(latitude2 - latitude1)
+	deltaLongitude := toRadians(longitude2 - longitude1)
+	a := math.Sin(deltaLatitude/2)*math.Sin(deltaLatitude/2) +
+		math.Cos(toRadians(latitude1))*math.Cos(toRadians(latitude2))*math.Sin(deltaLongitude/2)*math.Sin(deltaLongitude/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
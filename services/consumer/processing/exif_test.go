@@ -0,0 +1,271 @@
+package processing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// tiffTag is an IFD entry, value holds count values of the tag type in little endian
+type tiffTag struct {
+	id    uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func shortTag(id uint16, v uint16) tiffTag {
+	return tiffTag{id: id, typ: 3, count: 1, value: binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func longTag(id uint16, v uint32) tiffTag {
+	return tiffTag{id: id, typ: 4, count: 1, value: binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func asciiTag(id uint16, s string) tiffTag {
+	return tiffTag{id: id, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// rationalTag holds numerator and denominator pairs
+func rationalTag(id uint16, pairs ...uint32) tiffTag {
+	var value []byte
+	for _, v := range pairs {
+		value = binary.LittleEndian.AppendUint32(value, v)
+	}
+	return tiffTag{id: id, typ: 5, count: uint32(len(pairs) / 2), value: value}
+}
+
+// exifTags are the tags of a photo taken in Bengaluru, 12.9716 N 77.5946 E
+func exifTags(orientation uint16) (ifd0, gps []tiffTag) {
+	ifd0 = []tiffTag{
+		asciiTag(0x0110, "Pixel 7"),
+		shortTag(0x0112, orientation),
+		asciiTag(0x0132, "2024:01:21 16:23:40"),
+	}
+	gps = []tiffTag{
+		asciiTag(0x0001, "N"),
+		rationalTag(0x0002, 12, 1, 58, 1, 1776, 100),
+		asciiTag(0x0003, "E"),
+		rationalTag(0x0004, 77, 1, 35, 1, 4056, 100),
+	}
+	return ifd0, gps
+}
+
+// buildTIFF lays out a little endian TIFF file with data right after the header,
+// followed by IFD0 and the GPS IFD when gps has tags
+func buildTIFF(data []byte, ifd0, gps []tiffTag) []byte {
+	ifdSize := func(tags []tiffTag) int {
+		size := 2 + 12*len(tags) + 4
+		for _, tag := range tags {
+			if len(tag.value) > 4 {
+				size += len(tag.value) + len(tag.value)%2
+			}
+		}
+		return size
+	}
+
+	ifd0Offset := 8 + len(data) + len(data)%2
+	ifd0 = append([]tiffTag(nil), ifd0...)
+	if len(gps) > 0 {
+		// The GPS pointer is part of IFD0, so its size is known before the offset is filled in
+		ifd0 = append(ifd0, longTag(0x8825, 0))
+		gpsOffset := ifd0Offset + ifdSize(ifd0)
+		ifd0[len(ifd0)-1] = longTag(0x8825, uint32(gpsOffset))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("II")
+	binary.Write(&buf, binary.LittleEndian, uint16(42))
+	binary.Write(&buf, binary.LittleEndian, uint32(ifd0Offset))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	writeIFD(&buf, ifd0)
+	if len(gps) > 0 {
+		writeIFD(&buf, gps)
+	}
+	return buf.Bytes()
+}
+
+// writeIFD appends an IFD at the end of buf with the values that don't fit an entry after it
+func writeIFD(buf *bytes.Buffer, tags []tiffTag) {
+	tags = append([]tiffTag(nil), tags...)
+	sort.Slice(tags, func(i, j int) bool { return tags[i].id < tags[j].id })
+
+	valueOffset := buf.Len() + 2 + 12*len(tags) + 4
+	var values bytes.Buffer
+	binary.Write(buf, binary.LittleEndian, uint16(len(tags)))
+	for _, tag := range tags {
+		binary.Write(buf, binary.LittleEndian, tag.id)
+		binary.Write(buf, binary.LittleEndian, tag.typ)
+		binary.Write(buf, binary.LittleEndian, tag.count)
+		if len(tag.value) <= 4 {
+			buf.Write(tag.value)
+			buf.Write(make([]byte, 4-len(tag.value)))
+			continue
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(valueOffset+values.Len()))
+		values.Write(tag.value)
+		if len(tag.value)%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	buf.Write(values.Bytes())
+}
+
+// buildJPEG encodes a width x height JPEG with the EXIF data in an APP1 segment
+func buildJPEG(t *testing.T, width, height int, exifData []byte) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if exifData == nil {
+		return encoded.Bytes()
+	}
+
+	segment := append([]byte("Exif\x00\x00"), exifData...)
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8, 0xFF, 0xE1})
+	binary.Write(&buf, binary.BigEndian, uint16(len(segment)+2))
+	buf.Write(segment)
+	buf.Write(encoded.Bytes()[2:])
+	return buf.Bytes()
+}
+
+func TestReadExif(t *testing.T) {
+	capturedAt := time.Date(2024, 1, 21, 16, 23, 40, 0, time.Local).UTC()
+	ifd0, gps := exifTags(6)
+	rotated := buildJPEG(t, 30, 20, buildTIFF(nil, ifd0, gps))
+	southWest := buildJPEG(t, 30, 20, buildTIFF(nil, ifd0, []tiffTag{
+		asciiTag(0x0001, "S"),
+		rationalTag(0x0002, 33, 1, 52, 1, 0, 1),
+		asciiTag(0x0003, "W"),
+		rationalTag(0x0004, 151, 1, 12, 1, 0, 1),
+	}))
+	badOrientation, _ := exifTags(9)
+
+	tests := []struct {
+		name        string
+		format      string
+		head        []byte
+		orientation int
+		cameraModel string
+		capturedAt  *time.Time
+		latitude    float64
+		longitude   float64
+	}{
+		{"rotated jpeg", "jpeg", rotated, 6, "Pixel 7", &capturedAt, 12.9716, 77.5946},
+		{"southern and western hemisphere", "jpeg", southWest, 6, "Pixel 7", &capturedAt, -(33 + 52.0/60), -(151 + 12.0/60)},
+		{"tiff", "tiff", buildTIFF(make([]byte, 16), ifd0, gps), 6, "Pixel 7", &capturedAt, 12.9716, 77.5946},
+		{"orientation out of range", "jpeg", buildJPEG(t, 30, 20, buildTIFF(nil, badOrientation, nil)), 1, "Pixel 7", &capturedAt, 0, 0},
+		{"jpeg without exif", "jpeg", buildJPEG(t, 30, 20, nil), 1, "", nil, 0, 0},
+		{"not jpeg or tiff", "png", rotated, 1, "", nil, 0, 0},
+		{"truncated", "jpeg", rotated[:30], 1, "", nil, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata := readExif(test.format, test.head)
+			if metadata.orientation != test.orientation {
+				t.Errorf("orientation %d, want %d", metadata.orientation, test.orientation)
+			}
+			if metadata.cameraModel != test.cameraModel {
+				t.Errorf("camera model %q, want %q", metadata.cameraModel, test.cameraModel)
+			}
+			if (metadata.capturedAt == nil) != (test.capturedAt == nil) ||
+				(metadata.capturedAt != nil && !metadata.capturedAt.Equal(*test.capturedAt)) {
+				t.Errorf("captured at %v, want %v", metadata.capturedAt, test.capturedAt)
+			}
+			if test.latitude == 0 && test.longitude == 0 {
+				if metadata.latitude != nil || metadata.longitude != nil {
+					t.Errorf("location %v %v, want none", *metadata.latitude, *metadata.longitude)
+				}
+				return
+			}
+			if metadata.latitude == nil || metadata.longitude == nil {
+				t.Fatal("location is missing")
+			}
+			if math.Abs(*metadata.latitude-test.latitude) > 1e-6 || math.Abs(*metadata.longitude-test.longitude) > 1e-6 {
+				t.Errorf("location %f %f, want %f %f", *metadata.latitude, *metadata.longitude, test.latitude, test.longitude)
+			}
+		})
+	}
+}
+
+func TestDownloadImageReadsTheExifOfATIFFAfterItsImageData(t *testing.T) {
+	p, _ := newTestProcessor(t)
+	// An uncompressed 500x300 gray image, its pixels put the IFDs beyond exifHeadSize
+	width, height := 500, 300
+	ifd0, gps := exifTags(6)
+	ifd0 = append(ifd0,
+		shortTag(256, uint16(width)),
+		shortTag(257, uint16(height)),
+		shortTag(258, 8),
+		shortTag(259, 1),
+		shortTag(262, 1),
+		longTag(273, 8),
+		shortTag(277, 1),
+		longTag(278, uint32(height)),
+		longTag(279, uint32(width*height)),
+	)
+	data := buildTIFF(make([]byte, width*height), ifd0, gps)
+	if len(data) <= exifHeadSize+width {
+		t.Fatalf("the TIFF has %d bytes, its IFDs have to start beyond %d", len(data), exifHeadSize)
+	}
+	server, _ := serveImage(t, data)
+
+	imageData, err := p.downloadImage(server.URL + "/store.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageData.Format != "tiff" || imageData.Orientation != 6 || imageData.Width != height || imageData.Height != width {
+		t.Fatalf("got a %s of %dx%d with orientation %d, want a tiff of %dx%d with orientation 6",
+			imageData.Format, imageData.Width, imageData.Height, imageData.Orientation, height, width)
+	}
+	if imageData.Latitude == nil || imageData.Longitude == nil ||
+		math.Abs(*imageData.Latitude-12.9716) > 1e-4 || math.Abs(*imageData.Longitude-77.5946) > 1e-4 {
+		t.Fatalf("got location %v %v, want 12.9716 77.5946", imageData.Latitude, imageData.Longitude)
+	}
+	if imageData.CameraModel != "Pixel 7" {
+		t.Fatalf("got camera %q, want Pixel 7", imageData.CameraModel)
+	}
+}
+
+func TestOrientedSize(t *testing.T) {
+	for orientation := 0; orientation <= 9; orientation++ {
+		width, height := orientedSize(30, 20, orientation)
+		rotated := orientation >= 5 && orientation <= 8
+		if rotated && (width != 20 || height != 30) {
+			t.Errorf("orientation %d: %dx%d, want 20x30", orientation, width, height)
+		}
+		if !rotated && (width != 30 || height != 20) {
+			t.Errorf("orientation %d: %dx%d, want 30x20", orientation, width, height)
+		}
+	}
+}
+
+func TestDistanceMeters(t *testing.T) {
+	tests := []struct {
+		name                                         string
+		latitude1, longitude1, latitude2, longitude2 float64
+		meters                                       float64
+	}{
+		{"same place", 12.9716, 77.5946, 12.9716, 77.5946, 0},
+		{"one degree of latitude", 0, 0, 1, 0, 111195},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, 111195},
+		{"Bengaluru to Mumbai", 12.9716, 77.5946, 19.0760, 72.8777, 845318},
+	}
+	for _, test := range tests {
+		meters := distanceMeters(test.latitude1, test.longitude1, test.latitude2, test.longitude2)
+		if math.Abs(meters-test.meters) > 1 {
+			t.Errorf("%s: %.0fm, want %.0fm", test.name, meters, test.meters)
+		}
+	}
+}
@@ -1,39 +1,134 @@
 package processing
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/srrathi/distributed-image-processor/database"
 	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/services/consumer/fetch"
+	"github.com/srrathi/distributed-image-processor/services/consumer/imagecache"
 	"github.com/srrathi/distributed-image-processor/utils"
-	"gorm.io/gorm"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 	"image"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ImageData represents the structure of image data fetched from the internet
+// Width and Height are after the EXIF orientation is applied
 type ImageData struct {
-	URL       string
-	Perimeter int
-	Error     error
+	URL         string
+	Width       int
+	Height      int
+	Format      string
+	ByteSize    int64
+	Perimeter   int
+	Orientation int
+	CapturedAt  *time.Time
+	CameraModel string
+	Latitude    *float64
+	Longitude   *float64
+	// Distance in meters to the store, set when the image and the store have a location
+	StoreDistance *float64
+	// The image was taken further than the allowed distance from the store
+	LocationMismatch bool
+	Error            error
 }
 
-func ProcessStoreVisits(jobData models.JobData, db *gorm.DB) error {
+// Processor processes the store visits of jobs, it is shared by all jobs of the consumer
+type Processor struct {
+	store   database.Store
+	cache   *imagecache.Cache
+	fetcher *fetch.Fetcher
+	// Formats of the images that are accepted, as named by the image package, e.g. jpeg
+	allowedFormats map[string]bool
+	// Images taken further from the store than this many meters are flagged, 0 disables the check
+	maxStoreDistance float64
+}
+
+func NewProcessor(store database.Store, cache *imagecache.Cache, fetcher *fetch.Fetcher, allowedFormats []string, maxStoreDistance float64) *Processor {
+	formats := make(map[string]bool)
+	for _, format := range allowedFormats {
+		formats[strings.ToLower(strings.TrimSpace(format))] = true
+	}
+	return &Processor{
+		store:            store,
+		cache:            cache,
+		fetcher:          fetcher,
+		allowedFormats:   formats,
+		maxStoreDistance: maxStoreDistance,
+	}
+}
+
+// visitResult is a successful store visit together with the images it was computed from
+type visitResult struct {
+	visit  models.StoreVisits
+	images []ImageData
+}
+
+func (p *Processor) ProcessStoreVisits(jobData models.JobData) error {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var errorResults []models.JobErrors
-	var successResults []models.StoreVisits
+	var successResults []visitResult
+	var failedImages []models.VisitImage
+	var storeErr error
+	storeResults := make([]models.StoreResult, len(jobData.StoreJobs))
 
-	for _, visit := range jobData.StoreJobs {
+	for index, visit := range jobData.StoreJobs {
 		wg.Add(1)
 
-		go func(visit models.StoreVisitData) {
+		go func(index int, visit models.StoreVisitData) {
 			defer wg.Done()
 
+			storeResult := models.StoreResult{
+				JobId:      uint64(jobData.JobId),
+				VisitIndex: index,
+				StoreId:    visit.StoreId,
+				VisitTime:  visit.VisitTime,
+				Status:     utils.STORE_SUCCEEDED,
+			}
+
+			// Fetch store info from database, visits of unknown stores fail without fetching their images
+			storeInfo, err := p.store.GetStoreInfoFromStoreId(visit.StoreId)
+			if err != nil {
+				mu.Lock()
+				storeErr = err
+				mu.Unlock()
+				return
+			}
+			if storeInfo == nil {
+				jobError := models.JobErrors{
+					JobId:   uint64(jobData.JobId),
+					StoreId: visit.StoreId,
+					Code:    utils.ERROR_UNKNOWN_STORE,
+					Error:   fmt.Sprintf("store %s is not in the store master", visit.StoreId),
+				}
+				storeResult.Status = utils.STORE_FAILED
+				storeResult.Reason = jobError.Error
+				mu.Lock()
+				errorResults = append(errorResults, jobError)
+				storeResults[index] = storeResult
+				mu.Unlock()
+				return
+			}
+
 			// Fetch images concurrently
-			imageData := fetchImages(visit.ImageUrl)
+			imageData := p.fetchImages(visit.ImageUrl)
+			p.compareLocations(storeInfo, imageData)
 
 			// Calculate total perimeter for the store visit
 			perimeterSum := calculatePerimeterSum(imageData)
@@ -41,60 +136,148 @@ func ProcessStoreVisits(jobData models.JobData, db *gorm.DB) error {
 			// Update the result
 			imageErr := getErrorString(imageData)
 			if imageErr != "" {
-				jobError := models.JobErrors{
-					JobId:   uint64(jobData.JobId),
-					StoreId: visit.StoreId,
-					Error:   imageErr,
+				// Every failed image is recorded with its own error
+				var jobErrors []models.JobErrors
+				for _, failed := range imageData {
+					if failed.Error == nil {
+						continue
+					}
+					jobErrors = append(jobErrors, models.JobErrors{
+						JobId:   uint64(jobData.JobId),
+						StoreId: visit.StoreId,
+						Code:    imageErrorCode(failed.Error),
+						Url:     failed.URL,
+						Error:   failed.Error.Error(),
+					})
 				}
+				storeResult.Status = utils.STORE_FAILED
+				storeResult.Reason = imageErr
+				images := toVisitImages(uint64(jobData.JobId), visit.StoreId, nil, imageData)
 				mu.Lock()
-				errorResults = append(errorResults, jobError)
+				errorResults = append(errorResults, jobErrors...)
+				failedImages = append(failedImages, images...)
+				storeResults[index] = storeResult
 				mu.Unlock()
 			} else {
-				// Fetch store area from database
-				storeArea, _ := database.GetStoreAreaFromStoreId(db, visit.StoreId)
 				visitData := models.StoreVisits{
+					JobId:     uint64(jobData.JobId),
 					StoreId:   visit.StoreId,
-					StoreArea: storeArea,
+					StoreArea: storeInfo.StoreArea,
 					Perimeter: uint(perimeterSum),
 					VisitTime: visit.VisitTime,
 				}
 				mu.Lock()
-				successResults = append(successResults, visitData)
+				successResults = append(successResults, visitResult{visit: visitData, images: imageData})
+				storeResults[index] = storeResult
 				mu.Unlock()
 			}
-		}(visit)
+		}(index, visit)
 	}
 
 	// Wait for all goroutines to finish
 	wg.Wait()
 
-	if len(errorResults) > 0 {
-		err := database.WriteErrorStoresData(db, &errorResults)
-		if err != nil {
+	// The store master could not be read, the job is tried again as a whole
+	if storeErr != nil {
+		return storeErr
+	}
+
+	// The results of an earlier delivery of the job are replaced, so a redelivered or retried job
+	// ends up with the same rows as a job processed once
+	jobId := uint64(jobData.JobId)
+	return p.store.Transaction(func(tx database.Store) error {
+		if err := tx.DeleteJobResults(jobId); err != nil {
 			return err
 		}
 
-		err = database.UpdateJobStatusDatabase(db, uint64(jobData.JobId), utils.JOB_FAILED)
-		if err != nil {
-			return err
+		if len(errorResults) > 0 {
+			err := tx.WriteErrorStoresData(&errorResults)
+			if err != nil {
+				return err
+			}
 		}
-	} else {
-		err := database.UpdateJobStatusDatabase(db, uint64(jobData.JobId), utils.JOB_COMPLETED)
-		if err != nil {
-			return err
+
+		visitImages := failedImages
+		if len(successResults) > 0 {
+			visits := make([]models.StoreVisits, len(successResults))
+			for i, result := range successResults {
+				visits[i] = result.visit
+			}
+			err := tx.WriteStoresVisitsData(&visits)
+			if err != nil {
+				return err
+			}
+
+			// The visit ids are only known once the visits are written
+			for i, result := range successResults {
+				visitId := visits[i].Id
+				visitImages = append(visitImages, toVisitImages(jobId, result.visit.StoreId, &visitId, result.images)...)
+			}
+		}
+
+		if len(visitImages) > 0 {
+			err := tx.WriteVisitImages(&visitImages)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(storeResults) > 0 {
+			err := tx.WriteStoreResults(&storeResults)
+			if err != nil {
+				return err
+			}
 		}
+
+		// The status is written with the results so a finished job always has all of its results
+		return tx.UpdateJobStatus(jobId, jobStatus(len(successResults), len(errorResults)))
+	})
+}
+
+// jobStatus derives the status of a processed job from the number of succeeded and failed store visits
+func jobStatus(succeeded, failed int) string {
+	switch {
+	case failed == 0:
+		return utils.JOB_COMPLETED
+	case succeeded == 0:
+		return utils.JOB_FAILED
 	}
+	return utils.JOB_PARTIALLY_COMPLETED
+}
 
-	if len(successResults) > 0 {
-		err := database.WriteStoresVisitsData(db, &successResults)
-		if err != nil {
-			return err
+// toVisitImages converts the fetched images of a visit into rows for the visit_images table
+func toVisitImages(jobId uint64, storeId string, visitId *uint, imageDataArray []ImageData) []models.VisitImage {
+	var images []models.VisitImage
+	for _, imageData := range imageDataArray {
+		visitImage := models.VisitImage{
+			VisitId:   visitId,
+			JobId:     jobId,
+			StoreId:   storeId,
+			Url:       imageData.URL,
+			Width:     imageData.Width,
+			Height:    imageData.Height,
+			Format:    imageData.Format,
+			ByteSize:  imageData.ByteSize,
+			Perimeter: imageData.Perimeter,
+
+			Orientation:      imageData.Orientation,
+			CapturedAt:       imageData.CapturedAt,
+			CameraModel:      imageData.CameraModel,
+			Latitude:         imageData.Latitude,
+			Longitude:        imageData.Longitude,
+			StoreDistance:    imageData.StoreDistance,
+			LocationMismatch: imageData.LocationMismatch,
 		}
+		if imageData.Error != nil {
+			visitImage.ErrorCode = imageErrorCode(imageData.Error)
+			visitImage.Error = imageData.Error.Error()
+		}
+		images = append(images, visitImage)
 	}
-	return nil
+	return images
 }
 
-func fetchImages(imageURLs []string) []ImageData {
+func (p *Processor) fetchImages(imageURLs []string) []ImageData {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var imageDataArray []ImageData
@@ -106,16 +289,19 @@ func fetchImages(imageURLs []string) []ImageData {
 			defer wg.Done()
 
 			// Fetch image data
-			imageData, err := fetchImage(url)
+			imageData, err := p.fetchImage(url)
+			if err != nil {
+				imageData = &ImageData{URL: url, Error: err}
+				// Keep the detected format of images that were rejected for it
+				var unsupported *unsupportedFormatError
+				if errors.As(err, &unsupported) {
+					imageData.Format = unsupported.format
+				}
+			}
 
 			// Append the result to the imageDataArray
 			mu.Lock()
-			imageDataArray = append(imageDataArray, ImageData{URL: url, Perimeter: func() int {
-				if imageData != nil {
-					return *imageData
-				}
-				return 0
-			}(), Error: err})
+			imageDataArray = append(imageDataArray, *imageData)
 			mu.Unlock()
 		}(url)
 	}
@@ -126,25 +312,148 @@ func fetchImages(imageURLs []string) []ImageData {
 	return imageDataArray
 }
 
-func fetchImage(url string) (*int, error) {
-	// Fetch the image
-	resp, err := http.Get(url)
+// fetchImage returns the size of the image at url if its format is allowed
+func (p *Processor) fetchImage(url string) (*ImageData, error) {
+	imageData, err := p.downloadImage(url)
+	if err != nil {
+		return nil, err
+	}
+	// Checked on cached images too, the allowed formats may have changed since they were fetched
+	if !p.allowedFormats[imageData.Format] {
+		return nil, &unsupportedFormatError{format: imageData.Format}
+	}
+	return imageData, nil
+}
+
+// downloadImage returns the size of the image at url, from the cache if the url was fetched before
+func (p *Processor) downloadImage(url string) (*ImageData, error) {
+	cached, fresh := p.cache.Lookup(url)
+	if cached != nil && fresh {
+		return cachedImageData(url, cached.Content), nil
+	}
+
+	// Ask the server whether the cached image is still current
+	header := http.Header{}
+	if cached != nil {
+		if cached.Source.ETag != "" {
+			header.Set("If-None-Match", cached.Source.ETag)
+		}
+		if cached.Source.LastModified != "" {
+			header.Set("If-Modified-Since", cached.Source.LastModified)
+		}
+	}
+
+	// Fetch the image, failed responses are returned as errors
+	resp, err := p.fetcher.Get(url, header)
 	if err != nil {
 		log.Println("Error fetching the image:", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// Decode the image
-	config, _, err := image.DecodeConfig(resp.Body)
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		p.cache.Revalidated(url)
+		return cachedImageData(url, cached.Content), nil
+	}
+
+	// Read the whole image, its hash tells whether it was decoded before under another url
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading the image:", err)
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if known := p.cache.LookupContent(hash); known != nil {
+		p.cache.Save(url, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), *known)
+		return cachedImageData(url, *known), nil
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		// None of the decoders recognized the image, name it by its Content-Type instead
+		err = &unsupportedFormatError{format: formatFromContentType(resp.Header.Get("Content-Type"))}
+	}
 	if err != nil {
 		log.Println("Error determining image format:", err)
 		return nil, err
 	}
 
-	// Calculate the perimeter (twice the sum of width and height)
-	perimeter := 2 * (config.Width + config.Height)
-	return &perimeter, nil
+	// The EXIF data of a TIFF is in its IFDs, which may follow the image data anywhere in the file
+	exifData := data[:min(len(data), exifHeadSize)]
+	if format == "tiff" {
+		exifData = data
+	}
+	metadata := readExif(format, exifData)
+	width, height := orientedSize(config.Width, config.Height, metadata.orientation)
+	content := models.ImageContent{
+		Hash:        hash,
+		Width:       width,
+		Height:      height,
+		Format:      format,
+		ByteSize:    int64(len(data)),
+		Orientation: metadata.orientation,
+		CapturedAt:  metadata.capturedAt,
+		CameraModel: metadata.cameraModel,
+		Latitude:    metadata.latitude,
+		Longitude:   metadata.longitude,
+	}
+	p.cache.Save(url, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), content)
+
+	return cachedImageData(url, content), nil
+}
+
+// cachedImageData converts a decoded image into the image data of url
+func cachedImageData(url string, content models.ImageContent) *ImageData {
+	return &ImageData{
+		URL:      url,
+		Width:    content.Width,
+		Height:   content.Height,
+		Format:   content.Format,
+		ByteSize: content.ByteSize,
+		// Calculate the perimeter (twice the sum of width and height)
+		Perimeter:   2 * (content.Width + content.Height),
+		Orientation: content.Orientation,
+		CapturedAt:  content.CapturedAt,
+		CameraModel: content.CameraModel,
+		Latitude:    content.Latitude,
+		Longitude:   content.Longitude,
+	}
+}
+
+// compareLocations sets how far from the store the images were taken, for images with GPS
+// data of stores with a location
+func (p *Processor) compareLocations(storeInfo *models.StoreData, imageDataArray []ImageData) {
+	if storeInfo.Latitude == nil || storeInfo.Longitude == nil {
+		return
+	}
+	for i := range imageDataArray {
+		imageData := &imageDataArray[i]
+		if imageData.Latitude == nil || imageData.Longitude == nil {
+			continue
+		}
+		distance := distanceMeters(*storeInfo.Latitude, *storeInfo.Longitude, *imageData.Latitude, *imageData.Longitude)
+		imageData.StoreDistance = &distance
+		imageData.LocationMismatch = p.maxStoreDistance > 0 && distance > p.maxStoreDistance
+	}
+}
+
+// unsupportedFormatError is an image in a format that has no decoder or is not allowed
+type unsupportedFormatError struct {
+	format string
+}
+
+func (e *unsupportedFormatError) Error() string {
+	return fmt.Sprintf("image format %s is not supported", e.format)
+}
+
+// formatFromContentType names the format of an image that could not be decoded, e.g. avif for image/avif
+func formatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" {
+		return "unknown"
+	}
+	return strings.TrimPrefix(mediaType, "image/")
 }
 
 func calculatePerimeterSum(imageDataArray []ImageData) int {
@@ -157,6 +466,29 @@ func calculatePerimeterSum(imageDataArray []ImageData) int {
 	return perimeterSum
 }
 
+// imageErrorCode returns the code of the JobErrors entry for an image that failed with err
+func imageErrorCode(err error) string {
+	var fetchErr *fetch.Error
+	if errors.As(err, &fetchErr) {
+		switch fetchErr.Kind {
+		case fetch.ErrorTimeout:
+			return utils.ERROR_FETCH_TIMEOUT
+		case fetch.ErrorStatus:
+			return fmt.Sprintf("%s%d", utils.ERROR_HTTP_PREFIX, fetchErr.StatusCode)
+		case fetch.ErrorTooLarge:
+			return utils.ERROR_IMAGE_TOO_LARGE
+		case fetch.ErrorInvalidURL:
+			return utils.ERROR_INVALID_URL
+		}
+		return utils.ERROR_FETCH_FAILED
+	}
+	var unsupported *unsupportedFormatError
+	if errors.As(err, &unsupported) {
+		return utils.ERROR_UNSUPPORTED_FORMAT
+	}
+	return utils.ERROR_DECODE
+}
+
 func getErrorString(imageDataArray []ImageData) string {
 	for _, imageData := range imageDataArray {
 		if imageData.Error != nil {
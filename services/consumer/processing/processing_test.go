@@ -0,0 +1,128 @@
+package processing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/services/consumer/fetch"
+	"github.com/srrathi/distributed-image-processor/services/consumer/imagecache"
+)
+
+// newTestProcessor returns a processor over a SQLite store that accepts every format
+func newTestProcessor(t *testing.T) (*Processor, database.Store) {
+	t.Helper()
+	db, err := database.OpenConnection(&database.Config{
+		Driver: database.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "images.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := database.NewGormStore(db)
+	fetcher := fetch.NewFetcher(fetch.Config{
+		MaxConcurrent:  4,
+		MaxPerHost:     2,
+		ConnectTimeout: time.Second,
+		Timeout:        5 * time.Second,
+		MaxAttempts:    1,
+		MaxBytes:       1 << 20,
+	})
+	formats := []string{"jpeg", "png", "gif", "webp", "bmp", "tiff"}
+	return NewProcessor(store, imagecache.New(store, time.Hour, time.Hour, 0), fetcher, formats, 0), store
+}
+
+// serveImage serves data at every path and counts the requests
+func serveImage(t *testing.T, data []byte) (*httptest.Server, *int) {
+	t.Helper()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestImageErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{&fetch.Error{Kind: fetch.ErrorTimeout}, "FETCH_TIMEOUT"},
+		{&fetch.Error{Kind: fetch.ErrorNetwork}, "FETCH_FAILED"},
+		{&fetch.Error{Kind: fetch.ErrorStatus, StatusCode: 404}, "HTTP_404"},
+		{&fetch.Error{Kind: fetch.ErrorStatus, StatusCode: 503}, "HTTP_503"},
+		{&fetch.Error{Kind: fetch.ErrorTooLarge}, "IMAGE_TOO_LARGE"},
+		{&fetch.Error{Kind: fetch.ErrorInvalidURL}, "INVALID_URL"},
+		{fmt.Errorf("reading image: %w", &fetch.Error{Kind: fetch.ErrorTimeout}), "FETCH_TIMEOUT"},
+		{errors.New("unexpected EOF"), "DECODE_ERROR"},
+	}
+	for _, test := range tests {
+		if code := imageErrorCode(test.err); code != test.code {
+			t.Errorf("%v: got %s, want %s", test.err, code, test.code)
+		}
+	}
+}
+
+func TestDownloadImageUsesTheContentOfAKnownHash(t *testing.T) {
+	p, store := newTestProcessor(t)
+	var data bytes.Buffer
+	png.Encode(&data, image.NewGray(image.Rect(0, 0, 10, 20)))
+	server, requests := serveImage(t, data.Bytes())
+
+	// The same bytes were decoded before under another url, a width the image doesn't have shows the cached content is used
+	sum := sha256.Sum256(data.Bytes())
+	known := models.ImageContent{Hash: hex.EncodeToString(sum[:]), Width: 4242, Height: 20, Format: "png", ByteSize: int64(data.Len()), Orientation: 1}
+	err := store.SaveImage(&models.ImageSource{Url: "https://elsewhere.example/store.png", ContentHash: known.Hash, CheckedAt: time.Now().UTC()}, &known)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageData, err := p.downloadImage(server.URL + "/store.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageData.Width != 4242 || imageData.Height != 20 {
+		t.Fatalf("got %dx%d, want the cached 4242x20", imageData.Width, imageData.Height)
+	}
+
+	// The url now points at the content, so it is not fetched again while fresh
+	if _, err := p.downloadImage(server.URL + "/store.png"); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 1 {
+		t.Fatalf("%d requests, want 1", *requests)
+	}
+}
+
+func TestDownloadImageDecodesAnUnknownHash(t *testing.T) {
+	p, store := newTestProcessor(t)
+	var data bytes.Buffer
+	png.Encode(&data, image.NewGray(image.Rect(0, 0, 10, 20)))
+	server, _ := serveImage(t, data.Bytes())
+
+	imageData, err := p.downloadImage(server.URL + "/store.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageData.Width != 10 || imageData.Height != 20 || imageData.Format != "png" || imageData.ByteSize != int64(data.Len()) {
+		t.Fatalf("got %+v, want a 10x20 png of %d bytes", imageData, data.Len())
+	}
+	sum := sha256.Sum256(data.Bytes())
+	content, err := store.GetImageContent(hex.EncodeToString(sum[:]))
+	if err != nil || content == nil || content.Width != 10 {
+		t.Fatalf("got %+v, %v, want the decoded image cached by its hash", content, err)
+	}
+}
@@ -0,0 +1,135 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/internal"
+	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/utils"
+)
+
+const (
+	// AttemptHeader carries how many times the message has already been processed
+	AttemptHeader = "x-attempt"
+	// ErrorHeader carries the error of the last failed attempt
+	ErrorHeader = "x-last-error"
+)
+
+// QueueName returns the name of the retry queue holding messages for the given delay
+func QueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s%ds", utils.RBTMQ_RETRY_QUEUE_PREFIX, int(delay.Seconds()))
+}
+
+// Topology is the dead letter queue and one retry queue per delay
+// A retry queue has no consumer, messages expire after the delay and are dead-lettered
+// back onto the jobs queue through the default exchange
+func Topology() internal.Topology {
+	topology := internal.Topology{
+		Queues: []internal.QueueSpec{
+			{Name: utils.RBTMQ_DLQ_NAME, Durable: true},
+		},
+	}
+	for _, delay := range utils.RBTMQ_RETRY_DELAYS {
+		topology.Queues = append(topology.Queues, internal.QueueSpec{
+			Name:    QueueName(delay),
+			Durable: true,
+			Args: amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": utils.RBTMQ_QUEUE_NAME,
+			},
+		})
+	}
+	return topology
+}
+
+// Attempt returns the number of times the message has been processed before, starting from 0
+func Attempt(msg amqp.Delivery) int {
+	switch v := msg.Headers[AttemptHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// delayFor returns the retry delay for the given attempt, reusing the last delay once exhausted
+func delayFor(attempt int) time.Duration {
+	if attempt >= len(utils.RBTMQ_RETRY_DELAYS) {
+		return utils.RBTMQ_RETRY_DELAYS[len(utils.RBTMQ_RETRY_DELAYS)-1]
+	}
+	return utils.RBTMQ_RETRY_DELAYS[attempt]
+}
+
+// Reschedule is called when processing msg failed with cause
+// It re-publishes the message onto the matching retry queue, or once RBTMQ_MAX_ATTEMPTS is
+// reached it moves the message to the dead letter queue and marks the job as failed
+// jobId is 0 when the message could not be decoded, such messages are dead-lettered right away
+// The caller still has to ack msg when Reschedule succeeds
+func Reschedule(broker internal.Broker, store database.Store, msg amqp.Delivery, jobId uint64, cause error) error {
+	attempt := Attempt(msg) + 1
+
+	if jobId == 0 || attempt >= utils.RBTMQ_MAX_ATTEMPTS {
+		err := publish(broker, utils.RBTMQ_DLQ_NAME, msg, attempt, cause)
+		if err != nil {
+			return err
+		}
+		log.Printf("Job %d dead-lettered after %d attempt(s): %s\n", jobId, attempt, cause)
+
+		if jobId == 0 {
+			return nil
+		}
+		return markJobFailed(store, jobId, cause)
+	}
+
+	delay := delayFor(attempt - 1)
+	err := publish(broker, QueueName(delay), msg, attempt, cause)
+	if err != nil {
+		return err
+	}
+	log.Printf("Job %d scheduled for retry %d in %s: %s\n", jobId, attempt, delay, cause)
+	return nil
+}
+
+// publish sends a copy of msg through the default exchange directly onto queue
+func publish(broker internal.Broker, queue string, msg amqp.Delivery, attempt int, cause error) error {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[AttemptHeader] = int32(attempt)
+	headers[ErrorHeader] = cause.Error()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return broker.Publish(ctx, "", queue, amqp.Publishing{
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.MessageId,
+		Headers:      headers,
+		Body:         msg.Body,
+	})
+}
+
+// markJobFailed records the final error of a job that ran out of attempts
+func markJobFailed(store database.Store, jobId uint64, cause error) error {
+	jobErrors := []models.JobErrors{{
+		JobId: jobId,
+		Code:  utils.ERROR_PROCESSING_FAILED,
+		Error: cause.Error(),
+	}}
+	err := store.WriteErrorStoresData(&jobErrors)
+	if err != nil {
+		return err
+	}
+	return store.UpdateJobStatus(jobId, utils.JOB_FAILED)
+}
@@ -6,41 +6,107 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/models"
 	"github.com/srrathi/distributed-image-processor/utils"
-	"gorm.io/gorm"
 )
 
 type APIResponse struct {
-	Status string      `json:"status"`
-	JobID  uint64      `json:"job_id"`
-	Error  []ErrorInfo `json:"error,omitempty"`
+	Status string `json:"status"`
+	JobID  uint64 `json:"job_id"`
+	// Set when the job retries the failed store visits of another job
+	ParentJobID *uint64     `json:"parent_job_id,omitempty"`
+	Error       []ErrorInfo `json:"error,omitempty"`
+	// Counts and outcome per store visit, set once the job was processed
+	Summary *Summary       `json:"summary,omitempty"`
+	Stores  []StoreOutcome `json:"stores,omitempty"`
+	Images  []ImageInfo    `json:"images,omitempty"`
 }
 
+type Summary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// StoreOutcome is the result of a single store visit of the job
+// VisitIndex is the position of the visit in the submitted visits
+type StoreOutcome struct {
+	VisitIndex int    `json:"visit_index"`
+	StoreID    string `json:"store_id"`
+	VisitTime  string `json:"visit_time"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// ImageInfo is the processing result of a single image of the job
+// Width and Height are after the EXIF orientation is applied, the EXIF fields are empty when the image has none
+type ImageInfo struct {
+	StoreID          string     `json:"store_id"`
+	VisitID          *uint      `json:"visit_id"`
+	URL              string     `json:"url"`
+	Width            int        `json:"width"`
+	Height           int        `json:"height"`
+	Format           string     `json:"format"`
+	ByteSize         int64      `json:"byte_size"`
+	Perimeter        int        `json:"perimeter"`
+	Orientation      int        `json:"orientation,omitempty"`
+	CapturedAt       *time.Time `json:"captured_at,omitempty"`
+	CameraModel      string     `json:"camera_model,omitempty"`
+	Latitude         *float64   `json:"latitude,omitempty"`
+	Longitude        *float64   `json:"longitude,omitempty"`
+	StoreDistance    *float64   `json:"store_distance_m,omitempty"`
+	LocationMismatch bool       `json:"location_mismatch,omitempty"`
+	ErrorCode        string     `json:"error_code,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// ErrorInfo is a failure of the job, Code tells clients what went wrong and URL is the failed image
 type ErrorInfo struct {
 	StoreID string `json:"store_id"`
+	Code    string `json:"code"`
+	URL     string `json:"url,omitempty"`
 	Error   string `json:"error"`
 }
 
+// PayloadResponse is the request a job was submitted with
+type PayloadResponse struct {
+	JobID       uint64                  `json:"job_id"`
+	ParentJobID *uint64                 `json:"parent_job_id,omitempty"`
+	SubmittedAt time.Time               `json:"submitted_at"`
+	Client      ClientInfo              `json:"client"`
+	Count       int                     `json:"count"`
+	Visits      []models.StoreVisitData `json:"visits"`
+}
+
+// ClientInfo identifies who submitted the job
+type ClientInfo struct {
+	ID        string `json:"id"`
+	Address   string `json:"address"`
+	UserAgent string `json:"user_agent"`
+}
+
 func main() {
 	router := mux.NewRouter()
 	router.Use(utils.LoggingMiddleware)
 
-	db, err := database.NewConnection()
+	store, err := database.NewStore()
 	if err != nil {
 		log.Fatal("Could not load database,", err)
 	}
 
-	router.HandleFunc("/api/status", jobStatusHandler(db)).Methods("GET")
+	router.HandleFunc("/api/status", jobStatusHandler(store)).Methods("GET")
+	router.HandleFunc("/api/jobs/{id}/payload", jobPayloadHandler(store)).Methods("GET")
 	err = http.ListenAndServe(":5001", router)
 	if err != nil {
 		log.Println("There's an error with the server,", err)
 	}
 }
 
-func jobStatusHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request) {
+func jobStatusHandler(store database.Store) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		jobIdStr := req.URL.Query().Get("jobId")
 		jobIdStr = strings.Trim(jobIdStr, " ")
@@ -62,7 +128,7 @@ func jobStatusHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request
 		}
 
 		// fetching job status from database
-		jobStatusData, err := database.GetJobStatusData(db, jobIdInt)
+		jobStatusData, err := store.GetJobStatusData(jobIdInt)
 		if err != nil {
 			log.Println("Error:", err)
 			w.WriteHeader(http.StatusBadRequest) // Return 400 Bad Request.
@@ -74,8 +140,8 @@ func jobStatusHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request
 			Status: jobStatusData.JobStatus,
 			JobID:  jobStatusData.JobId,
 		}
-		if jobStatusData.JobStatus == utils.JOB_FAILED {
-			storeErrors, err := database.GetJobErrors(db, jobIdInt)
+		if jobStatusData.JobStatus == utils.JOB_FAILED || jobStatusData.JobStatus == utils.JOB_PARTIALLY_COMPLETED {
+			storeErrors, err := store.GetJobErrors(jobIdInt)
 			if err != nil {
 				log.Println("Error:", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -86,12 +152,131 @@ func jobStatusHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request
 			for _, storeError := range storeErrors {
 				errorInfo := ErrorInfo{
 					StoreID: storeError.StoreId, // Replace with the actual store ID
+					Code:    storeError.Code,
+					URL:     storeError.Url,
 					Error:   storeError.Error,
 				}
+				if errorInfo.Code == "" {
+					errorInfo.Code = utils.ERROR_UNKNOWN
+				}
 				response.Error = append(response.Error, errorInfo)
 			}
 		}
 
+		payload, err := store.GetJobPayload(jobIdInt)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if payload != nil {
+			response.ParentJobID = payload.ParentJobId
+		}
+
+		// Add the outcome of every store visit to the response
+		storeResults, err := store.GetStoreResults(jobIdInt)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(storeResults) > 0 {
+			response.Summary = &Summary{Total: len(storeResults)}
+		}
+		for _, storeResult := range storeResults {
+			if storeResult.Status == utils.STORE_SUCCEEDED {
+				response.Summary.Succeeded++
+			} else {
+				response.Summary.Failed++
+			}
+			response.Stores = append(response.Stores, StoreOutcome{
+				VisitIndex: storeResult.VisitIndex,
+				StoreID:    storeResult.StoreId,
+				VisitTime:  storeResult.VisitTime.Format(time.RFC3339),
+				Status:     storeResult.Status,
+				Reason:     storeResult.Reason,
+			})
+		}
+
+		// Add the per image results to the response
+		images, err := store.GetJobVisitImages(jobIdInt)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, image := range images {
+			response.Images = append(response.Images, ImageInfo{
+				StoreID:   image.StoreId,
+				VisitID:   image.VisitId,
+				URL:       image.Url,
+				Width:     image.Width,
+				Height:    image.Height,
+				Format:    image.Format,
+				ByteSize:  image.ByteSize,
+				Perimeter: image.Perimeter,
+
+				Orientation:      image.Orientation,
+				CapturedAt:       image.CapturedAt,
+				CameraModel:      image.CameraModel,
+				Latitude:         image.Latitude,
+				Longitude:        image.Longitude,
+				StoreDistance:    image.StoreDistance,
+				LocationMismatch: image.LocationMismatch,
+				ErrorCode:        image.ErrorCode,
+				Error:            image.Error,
+			})
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func jobPayloadHandler(store database.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		jobIdInt, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			log.Println("Error:", err)
+			w.WriteHeader(http.StatusBadRequest) // Return 400 Bad Request.
+			return
+		}
+
+		payload, err := store.GetJobPayload(jobIdInt)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if payload == nil {
+			log.Printf("Error: no payload stored for job with ID %d\n", jobIdInt)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+			return
+		}
+
+		var visits []models.StoreVisitData
+		err = json.Unmarshal([]byte(payload.Visits), &visits)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := PayloadResponse{
+			JobID:       payload.JobId,
+			ParentJobID: payload.ParentJobId,
+			SubmittedAt: payload.SubmittedAt,
+			Client: ClientInfo{
+				ID:        payload.ClientId,
+				Address:   payload.ClientAddress,
+				UserAgent: payload.UserAgent,
+			},
+			Count:  len(visits),
+			Visits: visits,
+		}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(response)
 	}
@@ -0,0 +1,117 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/database"
+)
+
+// Rows written between flushes, so the client receives the export while it is read
+const flushEvery = 1000
+
+// Columns of the CSV export
+var csvHeader = []string{"visit_id", "job_id", "store_id", "store_name", "area", "visit_time", "perimeter", "images"}
+
+// Row is a store visit of the NDJSON export
+type Row struct {
+	VisitId   uint      `json:"visit_id"`
+	JobId     uint64    `json:"job_id"`
+	StoreId   string    `json:"store_id"`
+	StoreName string    `json:"store_name"`
+	Area      string    `json:"area"`
+	VisitTime time.Time `json:"visit_time"`
+	Perimeter uint      `json:"perimeter"`
+	Images    int64     `json:"images"`
+}
+
+// WriteCSV streams the store visits matching the filter as CSV with a header row
+// Once the first row is written the status can't change anymore, a failure cuts the export short
+func WriteCSV(w http.ResponseWriter, store database.Store, filter database.StoreVisitsFilter, page database.StoreVisitsPage) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="visits.csv"`)
+
+	writer := csv.NewWriter(w)
+	flushWriter := func() error {
+		writer.Flush()
+		return writer.Error()
+	}
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	rows := 0
+	err := store.StreamStoreVisits(filter, page, func(visit *database.StoreVisitExport) error {
+		err := writer.Write([]string{
+			strconv.FormatUint(uint64(visit.Id), 10),
+			strconv.FormatUint(visit.JobId, 10),
+			visit.StoreId,
+			visit.StoreName,
+			visit.StoreArea,
+			visit.VisitTime.UTC().Format(time.RFC3339),
+			strconv.FormatUint(uint64(visit.Perimeter), 10),
+			strconv.FormatInt(visit.Images, 10),
+		})
+		if err != nil {
+			return err
+		}
+		rows++
+		if rows%flushEvery == 0 {
+			return flush(w, flushWriter)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush(w, flushWriter)
+}
+
+// WriteNDJSON streams the store visits matching the filter as one JSON object per line
+// Once the first row is written the status can't change anymore, a failure cuts the export short
+func WriteNDJSON(w http.ResponseWriter, store database.Store, filter database.StoreVisitsFilter, page database.StoreVisitsPage) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="visits.ndjson"`)
+
+	buffer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffer)
+	rows := 0
+	err := store.StreamStoreVisits(filter, page, func(visit *database.StoreVisitExport) error {
+		err := encoder.Encode(Row{
+			VisitId:   visit.Id,
+			JobId:     visit.JobId,
+			StoreId:   visit.StoreId,
+			StoreName: visit.StoreName,
+			Area:      visit.StoreArea,
+			VisitTime: visit.VisitTime.UTC(),
+			Perimeter: visit.Perimeter,
+			Images:    visit.Images,
+		})
+		if err != nil {
+			return err
+		}
+		rows++
+		if rows%flushEvery == 0 {
+			return flush(w, buffer.Flush)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush(w, buffer.Flush)
+}
+
+// flush hands the buffered rows to the client
+func flush(w http.ResponseWriter, flushBuffer func() error) error {
+	if err := flushBuffer(); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
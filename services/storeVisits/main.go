@@ -2,15 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/srrathi/distributed-image-processor/database"
 	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/services/storeVisits/export"
+	"github.com/srrathi/distributed-image-processor/services/storeVisits/query"
 	"github.com/srrathi/distributed-image-processor/utils"
-	"gorm.io/gorm"
 )
 
 type ErrorInfo struct {
@@ -18,8 +19,19 @@ type ErrorInfo struct {
 }
 
 type VisitData struct {
-	Date      string `json:"date"`
-	Perimeter uint   `json:"perimeter"`
+	Date      string      `json:"date"`
+	Perimeter uint        `json:"perimeter"`
+	Images    []ImageInfo `json:"images,omitempty"`
+}
+
+// ImageInfo is a single image the perimeter of a visit was computed from
+type ImageInfo struct {
+	URL       string `json:"url"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Format    string `json:"format"`
+	ByteSize  int64  `json:"byte_size"`
+	Perimeter int    `json:"perimeter"`
 }
 
 // ResponseFormat represents the desired response format
@@ -30,115 +42,252 @@ type ResponseFormat struct {
 	Data      []VisitData `json:"data"`
 }
 
+// VisitsResponse is a page of store visits, NextCursor is empty on the last page
+type VisitsResponse struct {
+	Results    []ResponseFormat `json:"results"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// AggregateResponse is a time series of store visit aggregates per store or area
+type AggregateResponse struct {
+	GroupBy  string            `json:"group_by"`
+	Interval string            `json:"interval"`
+	Series   []AggregateSeries `json:"series"`
+}
+
+// AggregateSeries are the aggregates of one store or area in the order of their periods
+// StoreName and Area are only set when grouped by store
+type AggregateSeries struct {
+	Key       string           `json:"key"`
+	StoreName string           `json:"store_name,omitempty"`
+	Area      string           `json:"area,omitempty"`
+	Points    []AggregatePoint `json:"points"`
+}
+
+// AggregatePoint sums up the visits of a period, periods without visits are left out
+type AggregatePoint struct {
+	Period         string  `json:"period"`
+	Visits         int64   `json:"visits"`
+	TotalPerimeter int64   `json:"total_perimeter"`
+	AvgPerimeter   float64 `json:"avg_perimeter"`
+	MinPerimeter   int64   `json:"min_perimeter"`
+	MaxPerimeter   int64   `json:"max_perimeter"`
+	Images         int64   `json:"images"`
+}
+
 func main() {
 	router := mux.NewRouter()
 	router.Use(utils.LoggingMiddleware)
 
-	db, err := database.NewConnection()
+	store, err := database.NewStore()
 	if err != nil {
 		log.Fatal("Could not load database,", err)
 	}
+	store = database.NewStoreMasterCache(store, utils.GetDurationEnv("STORE_CACHE_CHECK_INTERVAL", utils.STORE_CACHE_CHECK_INTERVAL))
 
-	router.HandleFunc("/api/visits", storeVisitsHandler(db)).Methods("GET")
+	router.HandleFunc("/api/visits", storeVisitsHandler(store)).Methods("GET")
+	router.HandleFunc("/api/visits/aggregate", aggregateVisitsHandler(store)).Methods("GET")
 	err = http.ListenAndServe(":5002", router)
 	if err != nil {
 		log.Println("There's an error with the server,", err)
 	}
 }
 
-func storeVisitsHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request) {
+func storeVisitsHandler(store database.Store) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		storeIdStr := req.URL.Query().Get("storeId")
-		area := req.URL.Query().Get("area")
-		startdateStr := req.URL.Query().Get("startdate")
-		enddateStr := req.URL.Query().Get("enddate")
-
 		w.Header().Set("Content-Type", "application/json")
 
-		if storeIdStr == "" && area == "" && startdateStr == "" && enddateStr == "" {
-			sendErrorResonse(w, http.StatusBadRequest, "invalid store id")
+		filter, err := query.ParseFilter(req.URL.Query())
+		if err == nil {
+			err = query.RequireFilter(filter)
+		}
+		if err == nil {
+			err = query.CheckStores(store, filter)
+		}
+		var page database.StoreVisitsPage
+		if err == nil {
+			page, err = query.ParsePage(req.URL.Query())
+		}
+		var format string
+		if err == nil {
+			format, err = query.ParseFormat(req)
+		}
+		var filterErr *query.Error
+		if errors.As(err, &filterErr) {
+			sendErrorResonse(w, http.StatusBadRequest, filterErr.Message)
 			return
 		}
-
-		var query *gorm.DB
-		if storeIdStr != "" {
-			query = db.Model(&models.StoreVisits{}).Where("store_id = ?", storeIdStr)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		if area != "" {
-			query = db.Model(&models.StoreVisits{}).Where("store_area = ?", area)
+		// Exports stream every matching visit straight from the database instead of a page
+		switch format {
+		case query.FormatCSV:
+			err = export.WriteCSV(w, store, filter, page)
+		case query.FormatNDJSON:
+			err = export.WriteNDJSON(w, store, filter, page)
 		}
-
-		if startdateStr != "" {
-			startdate, err := time.Parse(time.RFC3339, startdateStr)
+		if format != query.FormatJSON {
 			if err != nil {
-				sendErrorResonse(w, http.StatusBadRequest, "invalid format for start date time, acceptable format is RFC3339 time string, "+err.Error())
-				return
+				log.Println("Error exporting store visits:", err)
 			}
-			query = query.Where("visit_time >= ?", startdate)
+			return
 		}
 
-		if enddateStr != "" {
-			enddate, err := time.Parse(time.RFC3339, enddateStr)
-			if err != nil {
-				sendErrorResonse(w, http.StatusBadRequest, "invalid format for start date time, acceptable format is RFC3339 time string, "+err.Error())
-				return
-			}
-			query = query.Where("visit_time <= ?", enddate)
+		// Read one visit more than the page holds to know whether another page follows
+		limit := page.Limit
+		page.Limit++
+		storeVisits, err := store.GetStoreVisits(filter, page)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var nextCursor string
+		if len(storeVisits) > limit {
+			storeVisits = storeVisits[:limit]
+			nextCursor = query.NextCursor(page, storeVisits[limit-1])
 		}
 
-		// Get store visits data
-		storeVisits, err := database.GetStoreVisits(query)
+		// Fetch the images of all visits in one go and group them by visit
+		visitIds := make([]uint, len(storeVisits))
+		for i, visit := range storeVisits {
+			visitIds[i] = visit.Id
+		}
+		images, err := store.GetVisitImages(visitIds)
 		if err != nil {
 			log.Println("Error:", err)
 			http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		visitImages := make(map[uint][]ImageInfo)
+		for _, image := range images {
+			visitImages[*image.VisitId] = append(visitImages[*image.VisitId], ImageInfo{
+				URL:       image.Url,
+				Width:     image.Width,
+				Height:    image.Height,
+				Format:    image.Format,
+				ByteSize:  image.ByteSize,
+				Perimeter: image.Perimeter,
+			})
+		}
 
-		// Group visits data by store IDs
+		// Group visits data by store IDs, stores are in the order of their first visit on the page
+		// and the visits of a store keep the page order
+		var storeIds []string
 		storeVisitsData := make(map[string][]VisitData)
 		for _, visit := range storeVisits {
 			visitData := VisitData{
 				Date:      visit.VisitTime.Format("2006-01-02"),
 				Perimeter: visit.Perimeter,
+				Images:    visitImages[visit.Id],
+			}
+			if _, ok := storeVisitsData[visit.StoreId]; !ok {
+				storeIds = append(storeIds, visit.StoreId)
 			}
 			storeVisitsData[visit.StoreId] = append(storeVisitsData[visit.StoreId], visitData)
 		}
 
-		// Fetch store info for each unique store ID
-		storeInfoMap := make(map[string]*models.StoreData)
-		for storeID := range storeVisitsData {
-			storeInfo, err := database.GetStoreInfoFromStoreId(db, storeID)
+		// Fetch the store info of all stores on the page in one go
+		stores, err := store.GetStoresByIds(storeIds)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		storeInfoMap := make(map[string]models.StoreData, len(stores))
+		for _, storeInfo := range stores {
+			storeInfoMap[storeInfo.StoreId] = storeInfo
+		}
+
+		// Create response objects, stores missing from the store master have no area and name
+		response := VisitsResponse{Results: []ResponseFormat{}, NextCursor: nextCursor}
+		for _, storeID := range storeIds {
+			storeInfo := storeInfoMap[storeID]
+			response.Results = append(response.Results, ResponseFormat{
+				StoreID:   storeID,
+				Area:      storeInfo.StoreArea,
+				StoreName: storeInfo.StoreName,
+				Data:      storeVisitsData[storeID],
+			})
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func aggregateVisitsHandler(store database.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		filter, err := query.ParseFilter(req.URL.Query())
+		if err == nil {
+			err = query.CheckStores(store, filter)
+		}
+		var groupBy, interval string
+		if err == nil {
+			groupBy, interval, err = query.ParseAggregation(req.URL.Query())
+		}
+		var filterErr *query.Error
+		if errors.As(err, &filterErr) {
+			sendErrorResonse(w, http.StatusBadRequest, filterErr.Message)
+			return
+		}
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		aggregates, err := store.AggregateStoreVisits(filter, groupBy, interval)
+		if err != nil {
+			log.Println("Error:", err)
+			http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Aggregates are ordered by key and period, so each series is a run of rows
+		response := AggregateResponse{GroupBy: groupBy, Interval: interval, Series: []AggregateSeries{}}
+		var keys []string
+		for _, aggregate := range aggregates {
+			last := len(response.Series) - 1
+			if last < 0 || response.Series[last].Key != aggregate.Key {
+				response.Series = append(response.Series, AggregateSeries{Key: aggregate.Key})
+				keys = append(keys, aggregate.Key)
+				last++
+			}
+			response.Series[last].Points = append(response.Series[last].Points, AggregatePoint{
+				Period:         aggregate.Period,
+				Visits:         aggregate.Visits,
+				TotalPerimeter: aggregate.TotalPerimeter,
+				AvgPerimeter:   aggregate.AvgPerimeter,
+				MinPerimeter:   aggregate.MinPerimeter,
+				MaxPerimeter:   aggregate.MaxPerimeter,
+				Images:         aggregate.Images,
+			})
+		}
+
+		if groupBy == database.GroupByStore {
+			stores, err := store.GetStoresByIds(keys)
 			if err != nil {
 				log.Println("Error:", err)
 				http.Error(w, "internal server error,"+err.Error(), http.StatusInternalServerError)
 				return
 			}
-			storeInfoMap[storeID] = storeInfo
-		}
-
-		// Create response objects
-		var response []ResponseFormat
-		for storeID, visitsData := range storeVisitsData {
-			storeInfo := storeInfoMap[storeID]
-			if storeInfo != nil {
-				resp := ResponseFormat{
-					StoreID:   storeID,
-					Area:      storeInfo.StoreArea,
-					StoreName: storeInfo.StoreName,
-					Data:      visitsData,
-				}
-				response = append(response, resp)
-			} else {
-				resp := ResponseFormat{
-					StoreID:   storeID,
-					Area:      "",
-					StoreName: "",
-					Data:      visitsData,
-				}
-				response = append(response, resp)
+			storeInfoMap := make(map[string]models.StoreData, len(stores))
+			for _, storeInfo := range stores {
+				storeInfoMap[storeInfo.StoreId] = storeInfo
+			}
+			for i := range response.Series {
+				storeInfo := storeInfoMap[response.Series[i].Key]
+				response.Series[i].StoreName = storeInfo.StoreName
+				response.Series[i].Area = storeInfo.StoreArea
 			}
 		}
+
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(response)
 	}
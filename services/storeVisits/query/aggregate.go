@@ -0,0 +1,30 @@
+package query
+
+import (
+	"net/url"
+
+	"github.com/srrathi/distributed-image-processor/database"
+)
+
+// ParseAggregation reads groupBy and interval from the query parameters of a request
+// groupBy is store or area and defaults to store, interval is day, week or month and defaults to day
+func ParseAggregation(values url.Values) (string, string, error) {
+	groupBy := values.Get("groupBy")
+	switch groupBy {
+	case "":
+		groupBy = database.GroupByStore
+	case database.GroupByStore, database.GroupByArea:
+	default:
+		return "", "", &Error{Message: "groupBy has to be store or area"}
+	}
+
+	interval := values.Get("interval")
+	switch interval {
+	case "":
+		interval = database.IntervalDay
+	case database.IntervalDay, database.IntervalWeek, database.IntervalMonth:
+	default:
+		return "", "", &Error{Message: "interval has to be day, week or month"}
+	}
+	return groupBy, interval, nil
+}
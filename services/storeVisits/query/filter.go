@@ -0,0 +1,127 @@
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/database"
+)
+
+// Values accepted per list parameter, so a single request can't build an unbounded IN list
+const maxListValues = 100
+
+// Error is a filter that can't be answered, it is returned to the client as 400
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ParseFilter builds the store visits filter from the query parameters of a request
+// storeId and area can be repeated and hold comma separated values, startdate and enddate are RFC3339
+func ParseFilter(values url.Values) (database.StoreVisitsFilter, error) {
+	var filter database.StoreVisitsFilter
+
+	storeIds, err := parseList(values, "storeId")
+	if err != nil {
+		return filter, err
+	}
+	areas, err := parseList(values, "area")
+	if err != nil {
+		return filter, err
+	}
+	filter.StoreIds = storeIds
+	filter.Areas = areas
+
+	if filter.StartDate, err = parseTime(values, "startdate"); err != nil {
+		return filter, err
+	}
+	if filter.EndDate, err = parseTime(values, "enddate"); err != nil {
+		return filter, err
+	}
+
+	if filter.StartDate != nil && filter.EndDate != nil && filter.StartDate.After(*filter.EndDate) {
+		return filter, &Error{Message: "startdate has to be before enddate"}
+	}
+	return filter, nil
+}
+
+// RequireFilter rejects a filter that would select every store visit
+func RequireFilter(filter database.StoreVisitsFilter) error {
+	if len(filter.StoreIds) == 0 && len(filter.Areas) == 0 && filter.StartDate == nil && filter.EndDate == nil {
+		return &Error{Message: "at least one of storeId, area, startdate or enddate is required"}
+	}
+	return nil
+}
+
+// parseList returns the distinct values of a parameter given repeatedly or comma separated
+func parseList(values url.Values, name string) ([]string, error) {
+	var list []string
+	seen := make(map[string]bool)
+	for _, value := range values[name] {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				return nil, &Error{Message: fmt.Sprintf("%s contains an empty value", name)}
+			}
+			if !seen[item] {
+				seen[item] = true
+				list = append(list, item)
+			}
+		}
+	}
+	if len(list) > maxListValues {
+		return nil, &Error{Message: fmt.Sprintf("%s accepts at most %d values", name, maxListValues)}
+	}
+	return list, nil
+}
+
+func parseTime(values url.Values, name string) (*time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, &Error{Message: fmt.Sprintf("invalid format for %s, acceptable format is RFC3339 time string, %s", name, err)}
+	}
+	// Visit times are compared in UTC
+	t = t.UTC()
+	return &t, nil
+}
+
+// CheckStores rejects store ids that are in the store master but, when areas are given too,
+// not in any of those areas, such a filter can never match a visit
+// Store ids that are not in the store master are left to the query, they match no visits
+func CheckStores(store database.Store, filter database.StoreVisitsFilter) error {
+	if len(filter.StoreIds) == 0 || len(filter.Areas) == 0 {
+		return nil
+	}
+	stores, err := store.GetStoresByIds(filter.StoreIds)
+	if err != nil {
+		return err
+	}
+
+	areas := make(map[string]bool, len(filter.Areas))
+	for _, area := range filter.Areas {
+		areas[area] = true
+	}
+
+	var outside []string
+	for _, storeData := range stores {
+		if !areas[storeData.StoreArea] {
+			outside = append(outside, storeData.StoreId)
+		}
+	}
+	sort.Strings(outside)
+
+	if len(outside) > 0 {
+		return &Error{Message: fmt.Sprintf("store ids %s are not in area %s", strings.Join(outside, ", "), strings.Join(filter.Areas, ", "))}
+	}
+	return nil
+}
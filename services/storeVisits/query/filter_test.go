@@ -0,0 +1,115 @@
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+func TestParseFilter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	tooMany := make([]string, maxListValues+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("S%d", i)
+	}
+
+	tests := []struct {
+		name    string
+		query   url.Values
+		want    database.StoreVisitsFilter
+		wantErr bool
+	}{
+		{"nothing", url.Values{}, database.StoreVisitsFilter{}, false},
+		{"one store", url.Values{"storeId": {"S1"}}, database.StoreVisitsFilter{StoreIds: []string{"S1"}}, false},
+		{"repeated stores", url.Values{"storeId": {"S1", "S2"}}, database.StoreVisitsFilter{StoreIds: []string{"S1", "S2"}}, false},
+		{"comma separated stores", url.Values{"storeId": {"S1, S2,S1"}}, database.StoreVisitsFilter{StoreIds: []string{"S1", "S2"}}, false},
+		{"stores and areas", url.Values{"storeId": {"S1"}, "area": {"A1,A2"}}, database.StoreVisitsFilter{StoreIds: []string{"S1"}, Areas: []string{"A1", "A2"}}, false},
+		{"only startdate", url.Values{"startdate": {"2024-01-01T00:00:00Z"}}, database.StoreVisitsFilter{StartDate: &start}, false},
+		{"only enddate", url.Values{"enddate": {"2024-01-31T00:00:00Z"}}, database.StoreVisitsFilter{EndDate: &end}, false},
+		{"both dates", url.Values{"startdate": {"2024-01-01T00:00:00Z"}, "enddate": {"2024-01-31T00:00:00Z"}}, database.StoreVisitsFilter{StartDate: &start, EndDate: &end}, false},
+		{"empty store", url.Values{"storeId": {"S1,"}}, database.StoreVisitsFilter{}, true},
+		{"empty area", url.Values{"area": {""}}, database.StoreVisitsFilter{}, true},
+		{"too many stores", url.Values{"storeId": tooMany}, database.StoreVisitsFilter{}, true},
+		{"startdate not RFC3339", url.Values{"startdate": {"2024-01-01"}}, database.StoreVisitsFilter{}, true},
+		{"enddate not RFC3339", url.Values{"enddate": {"yesterday"}}, database.StoreVisitsFilter{}, true},
+		{"startdate after enddate", url.Values{"startdate": {"2024-01-31T00:00:00Z"}, "enddate": {"2024-01-01T00:00:00Z"}}, database.StoreVisitsFilter{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := ParseFilter(test.query)
+			if test.wantErr {
+				if _, ok := err.(*Error); !ok {
+					t.Fatalf("got %v, want a filter error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(filter, test.want) {
+				t.Fatalf("got %+v, want %+v", filter, test.want)
+			}
+		})
+	}
+}
+
+func TestRequireFilter(t *testing.T) {
+	if err := RequireFilter(database.StoreVisitsFilter{}); err == nil {
+		t.Fatal("an empty filter was accepted")
+	}
+	start := time.Now()
+	if err := RequireFilter(database.StoreVisitsFilter{StartDate: &start}); err != nil {
+		t.Fatalf("a filter with only startdate was rejected: %s", err)
+	}
+}
+
+func TestCheckStores(t *testing.T) {
+	db, err := database.OpenConnection(&database.Config{Driver: database.DriverSQLite, Path: filepath.Join(t.TempDir(), "stores.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := database.NewGormStore(db)
+	stores := []models.StoreData{
+		{StoreId: "S1", StoreArea: "A1"},
+		{StoreId: "S2", StoreArea: "A1"},
+		{StoreId: "S3", StoreArea: "A2"},
+	}
+	if err := store.CreateStores(&stores); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		filter  database.StoreVisitsFilter
+		wantErr bool
+	}{
+		{"no stores", database.StoreVisitsFilter{Areas: []string{"A1"}}, false},
+		{"known stores", database.StoreVisitsFilter{StoreIds: []string{"S1", "S3"}}, false},
+		{"unknown store", database.StoreVisitsFilter{StoreIds: []string{"S9"}}, false},
+		{"unknown store with area", database.StoreVisitsFilter{StoreIds: []string{"S9"}, Areas: []string{"A1"}}, false},
+		{"stores in area", database.StoreVisitsFilter{StoreIds: []string{"S1", "S2"}, Areas: []string{"A1"}}, false},
+		{"stores in one of the areas", database.StoreVisitsFilter{StoreIds: []string{"S1", "S3"}, Areas: []string{"A1", "A2"}}, false},
+		{"store outside area", database.StoreVisitsFilter{StoreIds: []string{"S1", "S3"}, Areas: []string{"A1"}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckStores(store, test.filter)
+			if test.wantErr {
+				if _, ok := err.(*Error); !ok {
+					t.Fatalf("got %v, want a filter error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package query
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Formats the store visits can be returned in
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Media types of the export formats
+var formatMediaTypes = map[string]string{
+	"text/csv":             FormatCSV,
+	"application/x-ndjson": FormatNDJSON,
+	"application/json":     FormatJSON,
+}
+
+// ParseFormat returns the format asked for by the format parameter, or else by the Accept header
+// The first supported media type of the Accept header wins, paged JSON is the default
+func ParseFormat(req *http.Request) (string, error) {
+	switch format := req.URL.Query().Get("format"); format {
+	case "":
+	case FormatJSON, FormatCSV, FormatNDJSON:
+		return format, nil
+	default:
+		return "", &Error{Message: "format has to be json, csv or ndjson"}
+	}
+
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if format, ok := formatMediaTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+	return FormatJSON, nil
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+const (
+	// Visits per page when limit is not given
+	defaultLimit = 100
+	// Largest limit a client can ask for
+	maxLimit = 1000
+)
+
+// cursor is the position after the last visit of a page, it is handed to clients as opaque
+// base64 JSON and carries the sort order so it can't be used with a different one
+type cursor struct {
+	Sort       string     `json:"s"`
+	Descending bool       `json:"d,omitempty"`
+	Id         uint       `json:"id"`
+	VisitTime  *time.Time `json:"t,omitempty"`
+	Perimeter  *uint      `json:"p,omitempty"`
+	StoreId    *string    `json:"k,omitempty"`
+}
+
+// ParsePage reads limit, sort, order and cursor from the query parameters of a request
+// sort is visit_time, perimeter or store_id and defaults to visit_time, order is asc or desc
+func ParsePage(values url.Values) (database.StoreVisitsPage, error) {
+	page := database.StoreVisitsPage{Sort: database.SortVisitTime, Limit: defaultLimit}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return page, &Error{Message: fmt.Sprintf("limit has to be a number from 1 to %d", maxLimit)}
+		}
+		page.Limit = limit
+	}
+
+	switch sort := values.Get("sort"); sort {
+	case "":
+	case database.SortVisitTime, database.SortPerimeter, database.SortStoreId:
+		page.Sort = sort
+	default:
+		return page, &Error{Message: "sort has to be one of visit_time, perimeter or store_id"}
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return page, &Error{Message: "order has to be asc or desc"}
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		after, err := decodeCursor(value, page)
+		if err != nil {
+			return page, err
+		}
+		page.After = after
+	}
+	return page, nil
+}
+
+// NextCursor returns the cursor of the page following the one that ended with last
+func NextCursor(page database.StoreVisitsPage, last models.StoreVisits) string {
+	position := cursor{Sort: page.Sort, Descending: page.Descending, Id: last.Id}
+	switch page.Sort {
+	case database.SortVisitTime:
+		position.VisitTime = &last.VisitTime
+	case database.SortPerimeter:
+		position.Perimeter = &last.Perimeter
+	case database.SortStoreId:
+		position.StoreId = &last.StoreId
+	}
+
+	data, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the visit a cursor points after, the cursor has to match the sort order of page
+func decodeCursor(value string, page database.StoreVisitsPage) (*models.StoreVisits, error) {
+	invalid := &Error{Message: "invalid cursor"}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, invalid
+	}
+	var position cursor
+	if err := json.Unmarshal(data, &position); err != nil {
+		return nil, invalid
+	}
+	if position.Sort != page.Sort || position.Descending != page.Descending {
+		return nil, &Error{Message: "cursor belongs to a different sort or order"}
+	}
+
+	after := &models.StoreVisits{Id: position.Id}
+	switch {
+	case page.Sort == database.SortVisitTime && position.VisitTime != nil:
+		after.VisitTime = position.VisitTime.UTC()
+	case page.Sort == database.SortPerimeter && position.Perimeter != nil:
+		after.Perimeter = *position.Perimeter
+	case page.Sort == database.SortStoreId && position.StoreId != nil:
+		after.StoreId = *position.StoreId
+	default:
+		return nil, invalid
+	}
+	return after, nil
+}
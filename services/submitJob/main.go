@@ -2,21 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math"
-	"math/rand"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/srrathi/distributed-image-processor/database"
 	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/services/submitJob/outbox"
 	"github.com/srrathi/distributed-image-processor/utils"
-	"gorm.io/gorm"
 )
 
 type RequestBody struct {
@@ -35,33 +39,70 @@ type ErrorInfo struct {
 }
 
 type SuccessInfo struct {
-	JobId int `json:"job_id"`
+	JobId       int     `json:"job_id"`
+	ParentJobId *uint64 `json:"parent_job_id,omitempty"`
+	// Visits of unknown stores that were accepted because UNKNOWN_STORE_POLICY is flag
+	Warnings []*IError `json:"warnings,omitempty"`
+}
+
+// ClientInfo identifies who submitted a job
+type ClientInfo struct {
+	Id        string
+	Address   string
+	UserAgent string
 }
 
 var Validator = validator.New()
 
+// errIdempotencyKeyTaken rolls back a job whose Idempotency-Key was claimed by a concurrent request
+var errIdempotencyKeyTaken = errors.New("idempotency key already taken")
+
 func main() {
 	router := mux.NewRouter()
 	router.Use(utils.LoggingMiddleware)
 
-	db, err := database.NewConnection()
+	store, err := database.NewStore()
 	if err != nil {
 		log.Fatal("Could not load database,", err)
 	}
+	store = database.NewStoreMasterCache(store, utils.GetDurationEnv("STORE_CACHE_CHECK_INTERVAL", utils.STORE_CACHE_CHECK_INTERVAL))
+
+	mqClient, err := utils.ConnectToRBMQ()
+	if err != nil {
+		log.Fatal("Could not connect to RabbitMQ,", err)
+	}
+	defer mqClient.Close()
+
+	err = mqClient.DeclareTopology(utils.JobsTopology())
+	if err != nil {
+		log.Fatal("Could not declare RabbitMQ topology,", err)
+	}
 
-	router.HandleFunc("/api/submit", submitJobHandler(db)).Methods("POST")
+	// The relay publishes the jobs written to the outbox
+	relay := outbox.NewRelay(store, mqClient, utils.GetDurationEnv("OUTBOX_POLL_INTERVAL", utils.OUTBOX_POLL_INTERVAL))
+	go relay.Run(context.Background())
+
+	router.HandleFunc("/api/submit", submitJobHandler(store, relay, utils.GetDurationEnv("IDEMPOTENCY_KEY_TTL", utils.IDEMPOTENCY_KEY_TTL), getUnknownStorePolicy())).Methods("POST")
+	router.HandleFunc("/api/jobs/{id}/retry", retryJobHandler(store, relay)).Methods("POST")
 	err = http.ListenAndServe(":5003", router)
 	if err != nil {
 		log.Println("There's an error with the server,", err)
 	}
 }
 
-func submitJobHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request) {
+func submitJobHandler(store database.Store, relay *outbox.Relay, idempotencyKeyTTL time.Duration, unknownStorePolicy string) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			log.Println("There was an error reading the request body")
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+
 		data := new(RequestBody)
-		err := json.NewDecoder(req.Body).Decode(data)
+		err = json.Unmarshal(body, data)
 		if err != nil {
 			log.Println("There was an error decoding the request body into the struct")
 			handleError(w, http.StatusInternalServerError, err)
@@ -79,23 +120,72 @@ func submitJobHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request
 			return
 		}
 
-		// generate a job ID
-		jobId := generateUniqueIntegerID(7)
-		jobData := models.JobData{
-			JobId:     jobId,
-			StoreJobs: data.Visits,
+		// A retried request with the same Idempotency-Key gets the response of the first one,
+		// without checking its stores again against a store master that may have changed since
+		idempotencyKey := strings.TrimSpace(req.Header.Get("Idempotency-Key"))
+		requestHash := hashRequest(body)
+		if idempotencyKey != "" {
+			record, err := store.GetIdempotencyRecord(idempotencyKey, idempotencyKeyTTL)
+			if err != nil {
+				log.Println(err.Error())
+				handleError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if record != nil {
+				replayIdempotentResponse(w, record, requestHash)
+				return
+			}
 		}
 
-		// send data to exchanger
-		err = sendDataToRBMQExchanger(jobData)
+		// Check all stores before the job is created, so nothing is published for a rejected request
+		unknownStores, err := checkStores(store, data.Visits)
 		if err != nil {
 			log.Println(err.Error())
 			handleError(w, http.StatusInternalServerError, err)
 			return
 		}
+		if len(unknownStores) > 0 && unknownStorePolicy == utils.UNKNOWN_STORE_REJECT {
+			writeValidationErrors(w, unknownStores)
+			return
+		}
 
-		// update status in database for jobs
-		err = database.UpdateJobStatusDatabase(db, uint64(jobId), utils.JOB_CREATED)
+		// The response is stored with the job, so a published job always has its idempotent response
+		// and a request that failed leaves no trace of its key
+		var successJobResponse []byte
+		var existing *models.IdempotencyRecord
+		_, err = submitJob(store, relay, data.Visits, nil, getClientInfo(req), func(tx database.Store, jobId int) error {
+			response, err := json.Marshal(SuccessInfo{
+				JobId:    jobId,
+				Warnings: unknownStores,
+			})
+			if err != nil {
+				return err
+			}
+			successJobResponse = response
+			if idempotencyKey == "" {
+				return nil
+			}
+			record, claimed, err := tx.ClaimIdempotencyKey(&models.IdempotencyRecord{
+				IdempotencyKey: idempotencyKey,
+				RequestHash:    requestHash,
+				JobId:          uint64(jobId),
+				StatusCode:     http.StatusCreated,
+				ResponseBody:   string(response),
+			}, idempotencyKeyTTL)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				existing = record
+				return errIdempotencyKeyTaken
+			}
+			return nil
+		})
+		if errors.Is(err, errIdempotencyKeyTaken) {
+			// A concurrent request with the same key won, its job is the one that counts
+			replayIdempotentResponse(w, existing, requestHash)
+			return
+		}
 		if err != nil {
 			log.Println(err.Error())
 			handleError(w, http.StatusInternalServerError, err)
@@ -103,14 +193,226 @@ func submitJobHandler(db *gorm.DB) func(w http.ResponseWriter, req *http.Request
 		}
 
 		// return created job response
+		w.WriteHeader(http.StatusCreated)
+		w.Write(successJobResponse)
+	}
+}
+
+// replayIdempotentResponse answers a request whose Idempotency-Key was already used
+func replayIdempotentResponse(w http.ResponseWriter, record *models.IdempotencyRecord, requestHash string) {
+	if record.RequestHash != requestHash {
+		handleError(w, http.StatusUnprocessableEntity, errors.New("Idempotency-Key was already used with a different request body"))
+		return
+	}
+	log.Printf("Replaying response of job %d for idempotency key %s\n", record.JobId, record.IdempotencyKey)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write([]byte(record.ResponseBody))
+}
+
+// hashRequest fingerprints a request body so a reused Idempotency-Key with another body can be detected
+func hashRequest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// retryJobHandler creates a new job with only the failed store visits of an existing job
+func retryJobHandler(store database.Store, relay *outbox.Relay) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		parentJobId, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, errors.New("invalid job id"))
+			return
+		}
+
+		jobStatusData, err := store.GetJobStatusData(parentJobId)
+		if err != nil {
+			handleError(w, http.StatusNotFound, err)
+			return
+		}
+		if jobStatusData.JobStatus != utils.JOB_FAILED && jobStatusData.JobStatus != utils.JOB_PARTIALLY_COMPLETED {
+			handleError(w, http.StatusConflict, fmt.Errorf("job with ID %d is %s, only failed or partially completed jobs can be retried", parentJobId, jobStatusData.JobStatus))
+			return
+		}
+
+		payload, err := store.GetJobPayload(parentJobId)
+		if err != nil {
+			log.Println(err.Error())
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if payload == nil {
+			handleError(w, http.StatusUnprocessableEntity, fmt.Errorf("the payload of job with ID %d was not stored, it cannot be retried", parentJobId))
+			return
+		}
+
+		var visits []models.StoreVisitData
+		err = json.Unmarshal([]byte(payload.Visits), &visits)
+		if err != nil {
+			log.Println(err.Error())
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		failedVisits, err := getFailedVisits(store, parentJobId, visits)
+		if err != nil {
+			log.Println(err.Error())
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if len(failedVisits) == 0 {
+			handleError(w, http.StatusConflict, fmt.Errorf("job with ID %d has no failed store visits", parentJobId))
+			return
+		}
+
+		jobId, err := submitJob(store, relay, failedVisits, &parentJobId, getClientInfo(req), nil)
+		if err != nil {
+			log.Println(err.Error())
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+
 		successJobResponse := SuccessInfo{
-			JobId: jobId,
+			JobId:       jobId,
+			ParentJobId: &parentJobId,
 		}
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(successJobResponse)
 	}
 }
 
+// getFailedVisits picks the visits of the payload whose store result failed
+// A job that failed as a whole, without any store result, is retried with all its visits
+func getFailedVisits(store database.Store, jobId uint64, visits []models.StoreVisitData) ([]models.StoreVisitData, error) {
+	storeResults, err := store.GetStoreResults(jobId)
+	if err != nil {
+		return nil, err
+	}
+	if len(storeResults) == 0 {
+		return visits, nil
+	}
+
+	// Jobs processed more than once before their results were replaced may hold a visit twice
+	var failedVisits []models.StoreVisitData
+	seen := make(map[int]bool)
+	for _, storeResult := range storeResults {
+		if storeResult.Status != utils.STORE_FAILED || seen[storeResult.VisitIndex] {
+			continue
+		}
+		seen[storeResult.VisitIndex] = true
+		if storeResult.VisitIndex < 0 || storeResult.VisitIndex >= len(visits) {
+			return nil, fmt.Errorf("store result of job %d points to unknown visit %d", jobId, storeResult.VisitIndex)
+		}
+		failedVisits = append(failedVisits, visits[storeResult.VisitIndex])
+	}
+	return failedVisits, nil
+}
+
+// checkStores returns a validation error for every visit whose store is not in the store master
+// The field of an error names the index of the visit, e.g. visits[3].store_id
+func checkStores(store database.Store, visits []models.StoreVisitData) ([]*IError, error) {
+	storeIds := make([]string, len(visits))
+	for i, visit := range visits {
+		storeIds[i] = visit.StoreId
+	}
+	knownStores, err := store.GetKnownStoreIds(storeIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var unknownStores []*IError
+	for i, visit := range visits {
+		if !knownStores[visit.StoreId] {
+			unknownStores = append(unknownStores, &IError{
+				Field: fmt.Sprintf("visits[%d].store_id", i),
+				Tag:   "unknown_store",
+				Value: visit.StoreId,
+			})
+		}
+	}
+	return unknownStores, nil
+}
+
+// getUnknownStorePolicy reads UNKNOWN_STORE_POLICY, reject or flag
+func getUnknownStorePolicy() string {
+	policy := os.Getenv("UNKNOWN_STORE_POLICY")
+	switch policy {
+	case "":
+		return utils.UNKNOWN_STORE_POLICY
+	case utils.UNKNOWN_STORE_REJECT, utils.UNKNOWN_STORE_FLAG:
+		return policy
+	}
+	log.Printf("Invalid UNKNOWN_STORE_POLICY %q, using %s\n", policy, utils.UNKNOWN_STORE_POLICY)
+	return utils.UNKNOWN_STORE_POLICY
+}
+
+// getClientInfo identifies the client by the X-Client-Id header and its address
+func getClientInfo(req *http.Request) ClientInfo {
+	address := req.RemoteAddr
+	// Behind a proxy the first forwarded address is the client
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		address = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return ClientInfo{
+		Id:        req.Header.Get("X-Client-Id"),
+		Address:   address,
+		UserAgent: req.UserAgent(),
+	}
+}
+
+// submitJob creates a new job, stores its payload and publishes it
+// created, when set, runs in the transaction of the job once its id is known
+func submitJob(store database.Store, relay *outbox.Relay, visits []models.StoreVisitData, parentJobId *uint64, client ClientInfo, created func(tx database.Store, jobId int) error) (int, error) {
+	visitsStr, err := json.Marshal(visits)
+	if err != nil {
+		return 0, err
+	}
+
+	// the job, its payload and its message are written in one transaction, so a job is
+	// never published without its record and never recorded without being published
+	var jobId int
+	err = store.Transaction(func(tx database.Store) error {
+		// the database allocates the job ID so it can never collide with an existing job
+		newJobId, err := tx.CreateJob(utils.JOB_CREATED)
+		if err != nil {
+			return err
+		}
+		jobId = int(newJobId)
+
+		// keep the payload for audit and so failed visits can be retried later
+		err = tx.SaveJobPayload(&models.JobPayload{
+			JobId:         newJobId,
+			ParentJobId:   parentJobId,
+			Visits:        string(visitsStr),
+			SubmittedAt:   time.Now().UTC(),
+			ClientId:      client.Id,
+			ClientAddress: client.Address,
+			UserAgent:     client.UserAgent,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = enqueueJobMessage(tx, models.JobData{
+			JobId:     jobId,
+			StoreJobs: visits,
+		})
+		if err != nil || created == nil {
+			return err
+		}
+		return created(tx, jobId)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// publish right away instead of waiting for the next poll
+	relay.Notify()
+	return jobId, nil
+}
+
 func handleValidationError(validationError error, w http.ResponseWriter) {
 	var errors []*IError
 	for _, err := range validationError.(validator.ValidationErrors) {
@@ -120,6 +422,11 @@ func handleValidationError(validationError error, w http.ResponseWriter) {
 		el.Value = err.Param()
 		errors = append(errors, &el)
 	}
+	writeValidationErrors(w, errors)
+}
+
+// writeValidationErrors answers with 400 and the list of validation errors
+func writeValidationErrors(w http.ResponseWriter, errors []*IError) {
 	jsonStr, err := json.Marshal(errors)
 	if err != nil {
 		log.Println("There was an error decoding the request body into the struct")
@@ -134,54 +441,20 @@ func handleValidationError(validationError error, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(errorResponse)
 }
 
-func generateUniqueIntegerID(digits int) int {
-	if digits < 0 {
-		digits = 7
-	}
-	// Calculate the range based on the number of digits
-	minValue := int(math.Pow10(digits - 1))
-	maxValue := int(math.Pow10(digits)) - 1
-
-	// Generate a random integer within the specified range
-	return rand.Intn(maxValue-minValue+1) + minValue
-}
-
-func sendDataToRBMQExchanger(data models.JobData) error {
-	client, err := utils.ConnectToRBMQ()
-	if err != nil {
-		return err
-	}
-
-	err = client.CreateQueue(utils.RBTMQ_QUEUE_NAME, true, false)
-	if err != nil {
-		return err
-	}
-
-	// Create binding between the jobs_events exchange and the customers-created queue
-	err = client.CreateBinding(utils.RBTMQ_QUEUE_NAME, utils.RBTMQ_BINDING, utils.RBTMQ_EXCHANGE)
-	if err != nil {
-		return err
-	}
-
-	// Create context to manage timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
+// enqueueJobMessage writes the job message to the outbox, the relay publishes it to the exchange
+func enqueueJobMessage(store database.Store, data models.JobData) error {
 	dataStr, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	err = client.Send(ctx, utils.RBTMQ_EXCHANGE, utils.RBTMQ_IP_JOB_ROUTING_KEY, amqp.Publishing{
-		ContentType:  "application/json",
-		DeliveryMode: amqp.Persistent, // This tells rabbitMQ that this message should be Saved if no resources accepts it before a restart (durable)
-		Body:         dataStr,
+	return store.EnqueueOutboxMessage(&models.OutboxMessage{
+		Exchange:    utils.RBTMQ_EXCHANGE,
+		RoutingKey:  utils.RBTMQ_IP_JOB_ROUTING_KEY,
+		ContentType: "application/json",
+		Body:        string(dataStr),
+		CreatedAt:   time.Now().UTC(),
 	})
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
 
 func handleError(w http.ResponseWriter, statusCode int, err error) {
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/internal"
+	"github.com/srrathi/distributed-image-processor/models"
+	"github.com/srrathi/distributed-image-processor/services/consumer/fetch"
+	"github.com/srrathi/distributed-image-processor/services/consumer/imagecache"
+	"github.com/srrathi/distributed-image-processor/services/consumer/processing"
+	"github.com/srrathi/distributed-image-processor/services/submitJob/outbox"
+	"github.com/srrathi/distributed-image-processor/utils"
+)
+
+// pipeline is the submit service and a consumer wired together over a MemoryBroker and SQLite
+type pipeline struct {
+	store     database.Store
+	broker    *internal.MemoryBroker
+	relay     *outbox.Relay
+	processor *processing.Processor
+	images    *httptest.Server
+}
+
+func newPipeline(t *testing.T) *pipeline {
+	t.Helper()
+	db, err := database.OpenConnection(&database.Config{
+		Driver: database.DriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "jobs.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := database.NewGormStore(db)
+	stores := []models.StoreData{
+		{StoreId: "S1", StoreArea: "A1", StoreName: "Store 1"},
+		{StoreId: "S2", StoreArea: "A2", StoreName: "Store 2"},
+	}
+	if err := store.CreateStores(&stores); err != nil {
+		t.Fatal(err)
+	}
+
+	// A 10x20 PNG, every other path is missing
+	var png10x20 bytes.Buffer
+	png.Encode(&png10x20, image.NewRGBA(image.Rect(0, 0, 10, 20)))
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/store.png" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png10x20.Bytes())
+	}))
+	t.Cleanup(images.Close)
+
+	broker := internal.NewMemoryBroker()
+	t.Cleanup(func() { broker.Close() })
+	// Both services declare the jobs topology, like they do against RabbitMQ
+	for i := 0; i < 2; i++ {
+		if err := broker.DeclareTopology(utils.JobsTopology()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	relay := outbox.NewRelay(store, broker, 10*time.Millisecond)
+	go relay.Run(ctx)
+
+	fetcher := fetch.NewFetcher(fetch.Config{
+		MaxConcurrent:  4,
+		MaxPerHost:     2,
+		ConnectTimeout: time.Second,
+		Timeout:        5 * time.Second,
+		MaxAttempts:    1,
+		MaxBytes:       1 << 20,
+	})
+	processor := processing.NewProcessor(store, imagecache.New(store, time.Hour, time.Hour, 0), fetcher, []string{"png"}, 0)
+
+	return &pipeline{store: store, broker: broker, relay: relay, processor: processor, images: images}
+}
+
+// submit posts the visits to the submit handler and returns the created job id
+func (p *pipeline) submit(t *testing.T, visits []models.StoreVisitData) uint64 {
+	t.Helper()
+	body, _ := json.Marshal(RequestBody{Count: len(visits), Visits: visits})
+	req := httptest.NewRequest(http.MethodPost, "/api/submit", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	submitJobHandler(p.store, p.relay, time.Hour, utils.UNKNOWN_STORE_REJECT)(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("submit answered %d: %s", rec.Code, rec.Body.String())
+	}
+	var success SuccessInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &success); err != nil {
+		t.Fatal(err)
+	}
+	return uint64(success.JobId)
+}
+
+// consume processes the next job message like the consumer service does, acks it and returns the job
+func (p *pipeline) consume(t *testing.T) models.JobData {
+	t.Helper()
+	deliveries, err := p.broker.Consume(utils.RBTMQ_QUEUE_NAME, utils.RBTMQ_CONSUMER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.broker.Cancel(utils.RBTMQ_CONSUMER)
+
+	var msg amqp.Delivery
+	select {
+	case msg = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no job message was published")
+	}
+	var jobData models.JobData
+	if err := json.Unmarshal(msg.Body, &jobData); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.store.UpdateJobStatus(uint64(jobData.JobId), utils.JOB_RUNNING); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.processor.ProcessStoreVisits(jobData); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.broker.Ack(msg); err != nil {
+		t.Fatal(err)
+	}
+	return jobData
+}
+
+func TestSubmitAndConsumeOverMemoryBroker(t *testing.T) {
+	p := newPipeline(t)
+	visitTime := time.Date(2024, 1, 21, 16, 23, 40, 0, time.UTC)
+	jobId := p.submit(t, []models.StoreVisitData{
+		{StoreId: "S1", VisitTime: visitTime, ImageUrl: []string{p.images.URL + "/store.png"}},
+		{StoreId: "S2", VisitTime: visitTime, ImageUrl: []string{p.images.URL + "/missing.png"}},
+	})
+	p.consume(t)
+
+	if n := p.broker.QueueLength(utils.RBTMQ_QUEUE_NAME); n != 0 {
+		t.Fatalf("%d job messages left, the job was published more than once", n)
+	}
+
+	job, err := p.store.GetJobStatusData(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.JobStatus != utils.JOB_PARTIALLY_COMPLETED {
+		t.Fatalf("job is %s, want %s", job.JobStatus, utils.JOB_PARTIALLY_COMPLETED)
+	}
+
+	visits, err := p.store.GetStoreVisits(database.StoreVisitsFilter{StoreIds: []string{"S1", "S2"}}, database.StoreVisitsPage{Sort: database.SortVisitTime, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visits) != 1 || visits[0].StoreId != "S1" || visits[0].Perimeter != 60 {
+		t.Fatalf("unexpected store visits %+v", visits)
+	}
+
+	results, err := p.store.GetStoreResults(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d store results, want 2", len(results))
+	}
+
+	jobErrors, err := p.store.GetJobErrors(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobErrors) != 1 || jobErrors[0].Code != "HTTP_404" || jobErrors[0].StoreId != "S2" {
+		t.Fatalf("unexpected job errors %+v", jobErrors)
+	}
+}
+
+func TestProcessingAJobAgainKeepsItsResults(t *testing.T) {
+	p := newPipeline(t)
+	visitTime := time.Date(2024, 1, 21, 16, 23, 40, 0, time.UTC)
+	jobId := p.submit(t, []models.StoreVisitData{
+		{StoreId: "S1", VisitTime: visitTime, ImageUrl: []string{p.images.URL + "/store.png", p.images.URL + "/store.png?size=2"}},
+		{StoreId: "S1", VisitTime: visitTime.Add(time.Hour), ImageUrl: []string{p.images.URL + "/store.png"}},
+		{StoreId: "S2", VisitTime: visitTime, ImageUrl: []string{p.images.URL + "/missing.png", p.images.URL + "/gone.png"}},
+	})
+	// A redelivered message is processed a second time
+	jobData := p.consume(t)
+	if err := p.processor.ProcessStoreVisits(jobData); err != nil {
+		t.Fatal(err)
+	}
+
+	visits, err := p.store.GetStoreVisits(database.StoreVisitsFilter{StoreIds: []string{"S1", "S2"}}, database.StoreVisitsPage{Sort: database.SortVisitTime, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visits) != 2 {
+		t.Fatalf("%d store visits, want 2", len(visits))
+	}
+	results, err := p.store.GetStoreResults(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d store results, want 3", len(results))
+	}
+	jobErrors, err := p.store.GetJobErrors(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobErrors) != 2 {
+		t.Fatalf("%d job errors, want 2", len(jobErrors))
+	}
+	images, err := p.store.GetJobVisitImages(jobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 5 {
+		t.Fatalf("%d visit images, want 5", len(images))
+	}
+}
+
+func TestGetFailedVisitsOncePerVisit(t *testing.T) {
+	p := newPipeline(t)
+	visits := []models.StoreVisitData{{StoreId: "S1"}, {StoreId: "S2"}}
+	// Results written by two deliveries of the same job
+	results := []models.StoreResult{
+		{JobId: 1, VisitIndex: 0, StoreId: "S1", Status: utils.STORE_SUCCEEDED},
+		{JobId: 1, VisitIndex: 1, StoreId: "S2", Status: utils.STORE_FAILED},
+		{JobId: 1, VisitIndex: 0, StoreId: "S1", Status: utils.STORE_SUCCEEDED},
+		{JobId: 1, VisitIndex: 1, StoreId: "S2", Status: utils.STORE_FAILED},
+	}
+	if err := p.store.WriteStoreResults(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := getFailedVisits(p.store, 1, visits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].StoreId != "S2" {
+		t.Fatalf("unexpected failed visits %+v", failed)
+	}
+}
+
+func TestSubmitWithIdempotencyKeyReplaysTheJob(t *testing.T) {
+	p := newPipeline(t)
+	body, _ := json.Marshal(RequestBody{Count: 1, Visits: []models.StoreVisitData{
+		{StoreId: "S1", VisitTime: time.Date(2024, 1, 21, 16, 23, 40, 0, time.UTC), ImageUrl: []string{p.images.URL + "/store.png"}},
+	}})
+
+	var responses []string
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/submit", bytes.NewReader(body))
+		req.Header.Set("Idempotency-Key", "submit-1")
+		rec := httptest.NewRecorder()
+		submitJobHandler(p.store, p.relay, time.Hour, utils.UNKNOWN_STORE_REJECT)(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("submit %d answered %d: %s", i, rec.Code, rec.Body.String())
+		}
+		responses = append(responses, rec.Body.String())
+	}
+	if responses[0] != responses[1] {
+		t.Fatalf("replayed response %s differs from %s", responses[1], responses[0])
+	}
+
+	p.consume(t)
+	if n := p.broker.QueueLength(utils.RBTMQ_QUEUE_NAME); n != 0 {
+		t.Fatalf("%d job messages left, the replayed request created another job", n)
+	}
+}
+
+// changedStoreMaster knows no store, like a store master the stores of a request were removed from
+type changedStoreMaster struct {
+	database.Store
+}
+
+func (s changedStoreMaster) GetKnownStoreIds(storeIds []string) (map[string]bool, error) {
+	return map[string]bool{}, nil
+}
+
+func TestReplayedSubmitIsNotCheckedAgainstTheStoreMaster(t *testing.T) {
+	p := newPipeline(t)
+	body, _ := json.Marshal(RequestBody{Count: 1, Visits: []models.StoreVisitData{
+		{StoreId: "S1", VisitTime: time.Date(2024, 1, 21, 16, 23, 40, 0, time.UTC), ImageUrl: []string{p.images.URL + "/store.png"}},
+	}})
+
+	var responses []*httptest.ResponseRecorder
+	for _, store := range []database.Store{p.store, changedStoreMaster{p.store}} {
+		req := httptest.NewRequest(http.MethodPost, "/api/submit", bytes.NewReader(body))
+		req.Header.Set("Idempotency-Key", "submit-1")
+		rec := httptest.NewRecorder()
+		submitJobHandler(store, p.relay, time.Hour, utils.UNKNOWN_STORE_REJECT)(rec, req)
+		responses = append(responses, rec)
+	}
+	replayed := responses[1]
+	if replayed.Code != http.StatusCreated || replayed.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replay answered %d: %s", replayed.Code, replayed.Body.String())
+	}
+	if replayed.Body.String() != responses[0].Body.String() {
+		t.Fatalf("replayed response %s differs from %s", replayed.Body.String(), responses[0].Body.String())
+	}
+}
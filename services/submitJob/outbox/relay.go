@@ -0,0 +1,123 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/srrathi/distributed-image-processor/database"
+	"github.com/srrathi/distributed-image-processor/internal"
+	"github.com/srrathi/distributed-image-processor/models"
+)
+
+const (
+	// Number of pending messages published per round
+	batchSize = 100
+	// How long published messages are kept in the outbox
+	retention = 24 * time.Hour
+	// How often published messages older than retention are removed
+	cleanupInterval = time.Hour
+)
+
+// Relay publishes pending outbox messages to the broker and marks them as sent
+// A message can be published more than once if marking it fails or several relays run,
+// consumers have to be idempotent
+type Relay struct {
+	store    database.Store
+	broker   internal.Broker
+	interval time.Duration
+	notify   chan struct{}
+}
+
+// NewRelay returns a relay that polls the outbox every interval and whenever Notify is called
+func NewRelay(store database.Store, broker internal.Broker, interval time.Duration) *Relay {
+	return &Relay{
+		store:    store,
+		broker:   broker,
+		interval: interval,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay up after a message was written to the outbox
+func (r *Relay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+		// A round is already pending
+	}
+}
+
+// Run publishes pending messages until ctx is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+
+	for {
+		r.publishPending(ctx)
+
+		if time.Since(lastCleanup) > cleanupInterval {
+			err := r.store.DeleteSentOutboxMessages(time.Now().UTC().Add(-retention))
+			if err != nil {
+				log.Println("Error cleaning up outbox:", err)
+			}
+			lastCleanup = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.notify:
+		}
+	}
+}
+
+// publishPending publishes pending messages in order until the outbox is empty or publishing fails
+func (r *Relay) publishPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := r.store.GetPendingOutboxMessages(batchSize)
+		if err != nil {
+			log.Println("Error reading outbox:", err)
+			return
+		}
+
+		for _, message := range messages {
+			err := r.publish(ctx, message)
+			if err != nil {
+				log.Printf("Error publishing outbox message %d: %s\n", message.Id, err)
+				if err := r.store.MarkOutboxMessageFailed(message.Id, err.Error()); err != nil {
+					log.Println("Error recording outbox failure:", err)
+				}
+				// The broker is likely unavailable, try again on the next round
+				return
+			}
+
+			err = r.store.MarkOutboxMessageSent(message.Id)
+			if err != nil {
+				log.Printf("Error marking outbox message %d as sent: %s\n", message.Id, err)
+				return
+			}
+		}
+
+		if len(messages) < batchSize {
+			return
+		}
+	}
+}
+
+func (r *Relay) publish(ctx context.Context, message models.OutboxMessage) error {
+	// Create context to manage timeout
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return r.broker.Publish(ctx, message.Exchange, message.RoutingKey, amqp.Publishing{
+		ContentType:  message.ContentType,
+		DeliveryMode: amqp.Persistent, // This tells rabbitMQ that this message should be Saved if no resources accepts it before a restart (durable)
+		MessageId:    strconv.FormatUint(uint64(message.Id), 10),
+		Body:         []byte(message.Body),
+	})
+}
@@ -4,6 +4,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/srrathi/distributed-image-processor/internal"
@@ -14,6 +17,37 @@ var (
 	JOB_COMPLETED = "completed"
 	JOB_RUNNING   = "running"
 	JOB_CREATED   = "created"
+	// Some store visits of the job succeeded and some failed
+	JOB_PARTIALLY_COMPLETED = "partially_completed"
+)
+
+var (
+	STORE_SUCCEEDED = "succeeded"
+	STORE_FAILED    = "failed"
+)
+
+// Codes of the job errors, clients use them to decide what to retry
+var (
+	// The image server did not answer in time
+	ERROR_FETCH_TIMEOUT = "FETCH_TIMEOUT"
+	// The connection to the image server failed
+	ERROR_FETCH_FAILED = "FETCH_FAILED"
+	// The image URL can't be fetched, it is malformed or not http or https
+	ERROR_INVALID_URL = "INVALID_URL"
+	// The image server answered with an error status, the status is appended, e.g. HTTP_404
+	ERROR_HTTP_PREFIX = "HTTP_"
+	// The image is larger than IMAGE_FETCH_MAX_BYTES
+	ERROR_IMAGE_TOO_LARGE = "IMAGE_TOO_LARGE"
+	// The image is not in a supported format
+	ERROR_UNSUPPORTED_FORMAT = "UNSUPPORTED_FORMAT"
+	// The image could not be read or decoded
+	ERROR_DECODE = "DECODE_ERROR"
+	// The store of the visit is not in the store master
+	ERROR_UNKNOWN_STORE = "UNKNOWN_STORE"
+	// The job kept failing and ran out of attempts
+	ERROR_PROCESSING_FAILED = "PROCESSING_FAILED"
+	// Errors recorded before codes were introduced
+	ERROR_UNKNOWN = "UNKNOWN"
 )
 
 var (
@@ -25,6 +59,75 @@ var (
 	RBTMQ_CONCURRENT_TASK_LIMIT = 10
 )
 
+var (
+	// Failed job messages are dead-lettered here once RBTMQ_MAX_ATTEMPTS is reached
+	RBTMQ_DLQ_NAME = "jobs_schedule.dlq"
+	// Prefix of the per-delay retry queues, the delay in seconds is appended
+	RBTMQ_RETRY_QUEUE_PREFIX = "jobs_schedule.retry."
+	// Delay before each retry, the last entry is reused when there are more attempts than delays
+	RBTMQ_RETRY_DELAYS = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+	// Total number of times a job message is processed before it is dead-lettered
+	RBTMQ_MAX_ATTEMPTS = 4
+)
+
+// How long the consumer waits for running jobs on shutdown, overridden by CONSUMER_SHUTDOWN_TIMEOUT
+var CONSUMER_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+var (
+	// Images downloaded at the same time by the consumer across all jobs, overridden by IMAGE_FETCH_CONCURRENCY
+	IMAGE_FETCH_CONCURRENCY = 64
+	// Connections to a single image host, overridden by IMAGE_FETCH_PER_HOST
+	IMAGE_FETCH_PER_HOST = 8
+	// Time limit of connecting to an image host, overridden by IMAGE_FETCH_CONNECT_TIMEOUT
+	IMAGE_FETCH_CONNECT_TIMEOUT = 10 * time.Second
+	// Time limit of a single image download, overridden by IMAGE_FETCH_TIMEOUT
+	IMAGE_FETCH_TIMEOUT = 30 * time.Second
+	// How long an unused connection to an image host is kept open, overridden by IMAGE_FETCH_IDLE_TIMEOUT
+	IMAGE_FETCH_IDLE_TIMEOUT = 90 * time.Second
+	// Downloads tried per image on timeouts, network errors and 5xx responses, overridden by IMAGE_FETCH_MAX_ATTEMPTS
+	IMAGE_FETCH_MAX_ATTEMPTS = 3
+	// Base of the random backoff between download attempts, overridden by IMAGE_FETCH_RETRY_DELAY
+	IMAGE_FETCH_RETRY_DELAY = 500 * time.Millisecond
+	// Largest image that is downloaded, overridden by IMAGE_FETCH_MAX_BYTES
+	IMAGE_FETCH_MAX_BYTES = 20 << 20
+)
+
+var (
+	// Submissions with a store_id that is not in the store master are rejected with 400
+	UNKNOWN_STORE_REJECT = "reject"
+	// Submissions with unknown stores are accepted with a warning, their visits fail with UNKNOWN_STORE
+	UNKNOWN_STORE_FLAG = "flag"
+	// What the submit service does with unknown stores, overridden by UNKNOWN_STORE_POLICY
+	UNKNOWN_STORE_POLICY = UNKNOWN_STORE_REJECT
+)
+
+// Image formats the consumer accepts, overridden by a comma separated IMAGE_ALLOWED_FORMATS
+var IMAGE_ALLOWED_FORMATS = []string{"jpeg", "png", "gif", "webp", "bmp", "tiff"}
+
+// Images taken further than this many meters from their store are flagged with location_mismatch,
+// 0 only records the distance, overridden by IMAGE_MAX_STORE_DISTANCE
+var IMAGE_MAX_STORE_DISTANCE = 0
+
+// How long a cached image is used without asking the server again, overridden by IMAGE_CACHE_FRESH_FOR
+var IMAGE_CACHE_FRESH_FOR = 1 * time.Hour
+
+// How long a cached image is kept after it was last fetched or revalidated, overridden by IMAGE_CACHE_RETENTION
+var IMAGE_CACHE_RETENTION = 30 * 24 * time.Hour
+
+// Most image urls kept in the cache, the least recently revalidated are removed first, 0 keeps any number,
+// overridden by IMAGE_CACHE_MAX_ENTRIES
+var IMAGE_CACHE_MAX_ENTRIES = 100000
+
+// How often the services check whether the store master changed and their cached copy has to be loaded
+// again, overridden by STORE_CACHE_CHECK_INTERVAL
+var STORE_CACHE_CHECK_INTERVAL = 5 * time.Second
+
+// How often the outbox relay looks for messages that were not published yet
+var OUTBOX_POLL_INTERVAL = 1 * time.Second
+
+// How long a submitted Idempotency-Key is remembered, overridden by IDEMPOTENCY_KEY_TTL
+var IDEMPOTENCY_KEY_TTL = 24 * time.Hour
+
 type Config struct {
 	Username    string
 	Password    string
@@ -42,6 +145,49 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// GetDurationEnv reads a duration such as 45s from the environment and falls back to the default
+func GetDurationEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s, using default: %s\n", name, err)
+		return defaultValue
+	}
+	return duration
+}
+
+// GetIntEnv reads a positive number from the environment and falls back to the default
+func GetIntEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		log.Printf("Invalid %s, using default: %q is not a positive number\n", name, value)
+		return defaultValue
+	}
+	return number
+}
+
+// GetListEnv reads a comma separated list from the environment and falls back to the default
+func GetListEnv(name string, defaultValue []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getRBTMQConfig() (*Config, error) {
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -61,13 +207,21 @@ func ConnectToRBMQ() (*internal.RabbitClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	conn, err := internal.ConnectRabbitMQ(config.Username, config.Password, config.Host, config.VirtualHost)
+	mqClient, err := internal.NewRabbitMQClient(config.Username, config.Password, config.Host, config.VirtualHost)
 	if err != nil {
 		return nil, err
 	}
-	mqClient, err := internal.NewRabbitMQClient(conn)
-	if err != nil {
-		return nil, err
+	return mqClient, nil
+}
+
+// JobsTopology is the jobs queue bound to the jobs exchange, shared by the producer and the consumer
+func JobsTopology() internal.Topology {
+	return internal.Topology{
+		Queues: []internal.QueueSpec{
+			{Name: RBTMQ_QUEUE_NAME, Durable: true},
+		},
+		Bindings: []internal.BindingSpec{
+			{Queue: RBTMQ_QUEUE_NAME, Binding: RBTMQ_BINDING, Exchange: RBTMQ_EXCHANGE},
+		},
 	}
-	return &mqClient, nil
 }